@@ -2,10 +2,12 @@ module github.com/nnicora/spire-agent-sidecar-buildpack
 
 go 1.19
 
-require github.com/cloudfoundry/libbuildpack v0.0.0-20230209225346-0e58f7be61d4
+require (
+	github.com/cloudfoundry/libbuildpack v0.0.0-20230209225346-0e58f7be61d4
+	gopkg.in/yaml.v2 v2.4.0
+)
 
 require (
 	github.com/Masterminds/semver v1.5.0 // indirect
 	github.com/blang/semver v3.5.1+incompatible // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,32 @@
+#!/bin/bash
+
+set -e
+set -u
+set -o pipefail
+
+# Downloads every dependency of manifest.yml and writes the sha256 of the archive
+# into the entry, so that libbuildpack can check the downloads at staging.
+function main() {
+  local manifest uri sum tmp
+  manifest="$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)/manifest.yml"
+  tmp="$(mktemp -d)"
+  trap "rm -rf '${tmp}'" EXIT
+
+  cp "${manifest}" "${tmp}/manifest.yml"
+  for uri in $(awk '$1 == "uri:" { print $2 }' "${manifest}"); do
+    echo "Downloading ${uri}"
+    curl --fail --silent --show-error --location --output "${tmp}/dependency" "${uri}"
+    sum="$(sha256sum "${tmp}/dependency" | cut -d ' ' -f 1)"
+
+    awk -v uri="${uri}" -v sum="${sum}" '
+      $1 == "uri:" { current = $2 }
+      $1 == "sha256:" && current == uri { sub(/sha256:.*/, "sha256: " sum); current = "" }
+      { print }
+    ' "${tmp}/manifest.yml" > "${tmp}/manifest.next"
+    mv "${tmp}/manifest.next" "${tmp}/manifest.yml"
+  done
+
+  cp "${tmp}/manifest.yml" "${manifest}"
+}
+
+main "$@"
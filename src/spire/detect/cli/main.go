@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/detect"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+func main() {
+	logger := libbuildpack.NewLogger(os.Stderr)
+
+	if len(os.Args) < 2 {
+		logger.Error("Usage: detect <build-dir>")
+		os.Exit(1)
+	}
+
+	buildpackDir, err := libbuildpack.GetBuildpackDir()
+	if err != nil {
+		logger.Error("Unable to determine buildpack directory: %s", err.Error())
+		os.Exit(9)
+	}
+
+	manifest, err := libbuildpack.NewManifest(buildpackDir, logger, time.Now())
+	if err != nil {
+		logger.Error("Unable to load buildpack manifest: %s", err.Error())
+		os.Exit(10)
+	}
+
+	versionLines, err := supply.LoadVersionLines(buildpackDir)
+	if err != nil {
+		logger.Error("Unable to load version lines: %s", err.Error())
+		os.Exit(10)
+	}
+
+	detector := detect.New(os.Args[1], manifest, versionLines)
+
+	detected, reason, err := detector.Detect()
+	if err != nil {
+		logger.Error("Unable to detect spire configuration: %s", err.Error())
+		os.Exit(1)
+	}
+	if !detected {
+		os.Exit(1)
+	}
+
+	version, err := detector.Version()
+	if err != nil {
+		logger.Error("Unable to resolve spire-agent version: %s", err.Error())
+		os.Exit(1)
+	}
+
+	logger.Debug("Detected spire configuration through %s", reason)
+	fmt.Fprintf(os.Stdout, "spire-agent %s\n", version)
+}
@@ -0,0 +1,89 @@
+package detect
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Detector struct {
+	BuildDir     string
+	Manifest     supply.Manifest
+	VersionLines map[string]string
+}
+
+func New(buildDir string, manifest supply.Manifest, versionLines map[string]string) *Detector {
+	return &Detector{
+		BuildDir:     buildDir,
+		Manifest:     manifest,
+		VersionLines: versionLines,
+	}
+}
+
+// Detect reports whether the buildpack applies to the application and the reason for it.
+// The buildpack applies when buildpack.yml has a `spire-agent` section, when VCAP_SERVICES
+// contains the spire binding which the supply phase selects, see
+// supply.SelectSpireBinding, or when the spire server address is given explicitly.
+func (d *Detector) Detect() (bool, string, error) {
+	config, err := d.loadConfig()
+	if err != nil {
+		return false, "", err
+	}
+	if _, ok := config["spire-agent"]; ok {
+		return true, "buildpack.yml", nil
+	}
+
+	services, err := supply.ParseVcapServices(os.Getenv(supply.VcapServicesEnv))
+	if err != nil {
+		return false, "", err
+	}
+	binding, err := supply.SelectSpireBinding(services, supply.ResolveBindingSelector(config))
+	if err != nil {
+		return false, "", err
+	}
+	if binding != nil {
+		return true, supply.VcapServicesEnv, nil
+	}
+
+	if strings.TrimSpace(os.Getenv(supply.ServerAddressEnv)) != "" {
+		return true, supply.ServerAddressEnv, nil
+	}
+
+	return false, "", nil
+}
+
+// Version returns the spire-agent version which the supply phase will install.
+func (d *Detector) Version() (string, error) {
+	var config supply.Config
+	configPath := filepath.Join(d.BuildDir, "buildpack.yml")
+	if exists, err := libbuildpack.FileExists(configPath); err != nil {
+		return "", err
+	} else if exists {
+		if err := libbuildpack.NewYAML().Load(configPath, &config); err != nil {
+			return "", err
+		}
+	}
+
+	dep, err := supply.ResolveSpireAgentVersion(d.Manifest, d.VersionLines, config.SpireAgent.Version)
+	if err != nil {
+		return "", err
+	}
+	return dep.Version, nil
+}
+
+func (d *Detector) loadConfig() (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+
+	configPath := filepath.Join(d.BuildDir, "buildpack.yml")
+	if exists, err := libbuildpack.FileExists(configPath); err != nil {
+		return nil, err
+	} else if exists {
+		if err := libbuildpack.NewYAML().Load(configPath, &config); err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
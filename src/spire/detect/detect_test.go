@@ -0,0 +1,198 @@
+package detect
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeManifest struct {
+	defaultVersion string
+	versions       []string
+}
+
+func (m *fakeManifest) DefaultVersion(depName string) (libbuildpack.Dependency, error) {
+	if m.defaultVersion == "" {
+		return libbuildpack.Dependency{}, fmt.Errorf("no default version for %s", depName)
+	}
+	return libbuildpack.Dependency{Name: depName, Version: m.defaultVersion}, nil
+}
+
+func (m *fakeManifest) AllDependencyVersions(string) []string {
+	return m.versions
+}
+
+func (m *fakeManifest) RootDir() string {
+	return ""
+}
+
+const twoSpireBindings = `{"spire":[` +
+	`{"name":"spire-dev","credentials":{"spire":{"host":"dev.example.org","port":8081},"workload":{"spiffeID":"spiffe://dev.example.org/app"}}},` +
+	`{"name":"spire-prod","credentials":{"spire":{"host":"prod.example.org","port":8081},"workload":{"spiffeID":"spiffe://prod.example.org/app"}}}]}`
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name           string
+		buildpackYml   string
+		vcapServices   string
+		serviceName    string
+		serverAddress  string
+		expected       bool
+		expectedReason string
+		expectErr      bool
+	}{
+		{
+			name:     "nothing configured",
+			expected: false,
+		},
+		{
+			name:           "buildpack.yml with spire-agent section",
+			buildpackYml:   "spire-agent:\n  version: 1.6.x\n",
+			expected:       true,
+			expectedReason: "buildpack.yml",
+		},
+		{
+			name:           "buildpack.yml with empty spire-agent section",
+			buildpackYml:   "spire-agent:\n",
+			expected:       true,
+			expectedReason: "buildpack.yml",
+		},
+		{
+			name:         "buildpack.yml without spire-agent section",
+			buildpackYml: "dist: foo\n",
+			expected:     false,
+		},
+		{
+			name:           "vcap services with spire credentials",
+			vcapServices:   `{"spire":[{"name":"spire","credentials":{"spire":{"host":"spire.example.org","port":8081},"workload":{"spiffeID":"spiffe://example.org/app"}}}]}`,
+			expected:       true,
+			expectedReason: supply.VcapServicesEnv,
+		},
+		{
+			name:         "vcap services without spire credentials",
+			vcapServices: `{"postgres":[{"name":"db","credentials":{"uri":"postgres://db"}}]}`,
+			expected:     false,
+		},
+		{
+			name:         "vcap services with an unrelated server address",
+			vcapServices: `{"ldap":[{"name":"directory","credentials":{"server_address":"ldap.corp:636/tcp","server_port":"ldaps"}}]}`,
+			expected:     false,
+		},
+		{
+			name:         "vcap services with partial spire credentials",
+			vcapServices: `{"spire":[{"name":"spire","credentials":{"spire":{"host":"spire.example.org","port":8081}}}]}`,
+			expected:     false,
+		},
+		{
+			name:           "vcap services with the selected spire binding",
+			vcapServices:   twoSpireBindings,
+			serviceName:    "spire-dev",
+			expected:       true,
+			expectedReason: supply.VcapServicesEnv,
+		},
+		{
+			name:         "vcap services with several spire bindings and no selector",
+			vcapServices: twoSpireBindings,
+			expectErr:    true,
+		},
+		{
+			name:         "vcap services without the selected spire binding",
+			vcapServices: twoSpireBindings,
+			serviceName:  "spire-test",
+			expectErr:    true,
+		},
+		{
+			name:         "malformed vcap services",
+			vcapServices: `{"spire":`,
+			expectErr:    true,
+		},
+		{
+			name:           "spire server address",
+			serverAddress:  "spire.example.org",
+			expected:       true,
+			expectedReason: supply.ServerAddressEnv,
+		},
+		{
+			name:          "blank spire server address",
+			serverAddress: "  ",
+			expected:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buildDir := t.TempDir()
+			if tt.buildpackYml != "" {
+				if err := os.WriteFile(filepath.Join(buildDir, "buildpack.yml"), []byte(tt.buildpackYml), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv(supply.VcapServicesEnv, tt.vcapServices)
+			t.Setenv("SPIRE_SERVICE_NAME", tt.serviceName)
+			t.Setenv(supply.ServerAddressEnv, tt.serverAddress)
+
+			detected, reason, err := New(buildDir, &fakeManifest{}, nil).Detect()
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if detected != tt.expected {
+				t.Errorf("detected = %v, expected %v", detected, tt.expected)
+			}
+			if reason != tt.expectedReason {
+				t.Errorf("reason = %q, expected %q", reason, tt.expectedReason)
+			}
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	manifest := &fakeManifest{defaultVersion: "1.6.3", versions: []string{"1.5.6", "1.6.3"}}
+	versionLines := map[string]string{"latest": "1.6.x", "lts": "1.5.x"}
+
+	tests := []struct {
+		name         string
+		buildpackYml string
+		expected     string
+		expectErr    bool
+	}{
+		{name: "default version", expected: "1.6.3"},
+		{name: "exact version", buildpackYml: "spire-agent:\n  version: 1.5.6\n", expected: "1.5.6"},
+		{name: "constraint", buildpackYml: "spire-agent:\n  version: 1.5.x\n", expected: "1.5.6"},
+		{name: "version line", buildpackYml: "spire-agent:\n  version: lts\n", expected: "1.5.6"},
+		{name: "unknown version", buildpackYml: "spire-agent:\n  version: 2.x\n", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buildDir := t.TempDir()
+			if tt.buildpackYml != "" {
+				if err := os.WriteFile(filepath.Join(buildDir, "buildpack.yml"), []byte(tt.buildpackYml), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			version, err := New(buildDir, manifest, versionLines).Version()
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if version != tt.expected {
+				t.Errorf("version = %q, expected %q", version, tt.expected)
+			}
+		})
+	}
+}
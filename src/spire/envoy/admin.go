@@ -0,0 +1,158 @@
+package envoy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	PrometheusListener = "prometheus_stats"
+	AdminCluster       = "envoy_admin"
+
+	// PrometheusPath is the path of the stats in the Prometheus format, on the admin
+	// interface and on the Prometheus listener.
+	PrometheusPath = "/stats/prometheus"
+)
+
+// AdminOptions configure the admin interface, which exposes the clusters, the
+// certificates and the stats of the proxy. It only binds a loopback address, for
+// `cf ssh`; the Prometheus listener exposes the stats alone on PrometheusPort when set.
+type AdminOptions struct {
+	Address           string
+	Port              int
+	PrometheusAddress string
+	PrometheusPort    int
+}
+
+func (o AdminOptions) withDefaults() AdminOptions {
+	if o.Address == "" {
+		o.Address = "127.0.0.1"
+	}
+	if o.Port == 0 {
+		o.Port = 9901
+	}
+	if o.PrometheusAddress == "" {
+		o.PrometheusAddress = "0.0.0.0"
+	}
+	return o
+}
+
+func (o AdminOptions) Validate() []string {
+	var problems []string
+
+	o = o.withDefaults()
+	if ip := net.ParseIP(o.Address); ip == nil || !ip.IsLoopback() {
+		problems = append(problems, fmt.Sprintf("envoy admin address `%s` is not a loopback address", o.Address))
+	}
+	if o.Port < 1 || o.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("envoy admin port %d is out of range 1-65535", o.Port))
+	}
+	if o.PrometheusPort != 0 {
+		if net.ParseIP(o.PrometheusAddress) == nil {
+			problems = append(problems, fmt.Sprintf("envoy prometheus address `%s` is not an IP address", o.PrometheusAddress))
+		}
+		if o.PrometheusPort < 1 || o.PrometheusPort > 65535 {
+			problems = append(problems, fmt.Sprintf("envoy prometheus port %d is out of range 1-65535", o.PrometheusPort))
+		}
+	}
+	return problems
+}
+
+// validateSinkAddress checks that a statsd sink is an `ip:port`; Envoy doesn't resolve
+// the sink addresses.
+func validateSinkAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("`%s` is not an ip:port", address)
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("host of `%s` is not an IP address", address)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("port of `%s` is out of range 1-65535", address)
+	}
+	return nil
+}
+
+func admin(o Options) *Admin {
+	a := o.Admin.withDefaults()
+	return &Admin{Address: socketAddress(a.Address, a.Port)}
+}
+
+// prometheusListener only routes the Prometheus stats path to the admin interface; the
+// other paths are answered with 404.
+func prometheusListener(o Options) Listener {
+	a := o.Admin.withDefaults()
+
+	return Listener{
+		Name:    PrometheusListener,
+		Address: socketAddress(a.PrometheusAddress, a.PrometheusPort),
+		FilterChains: []FilterChain{{
+			Filters: []NetworkFilter{{
+				Name: filterHTTPConnectionManager,
+				TypedConfig: HTTPConnectionManager{
+					Type:       typeHTTPConnectionManager,
+					CodecType:  "auto",
+					StatPrefix: PrometheusListener,
+					RouteConfig: RouteConfiguration{
+						Name: PrometheusListener,
+						VirtualHosts: []VirtualHost{{
+							Name:    PrometheusListener,
+							Domains: []string{"*"},
+							Routes: []Route{{
+								Match: RouteMatch{Path: PrometheusPath},
+								Route: &RouteAction{Cluster: AdminCluster},
+							}},
+						}},
+					},
+					HTTPFilters: []HTTPFilter{{
+						Name:        filterRouter,
+						TypedConfig: Router{Type: typeRouter},
+					}},
+				},
+			}},
+		}},
+	}
+}
+
+func adminCluster(o Options) Cluster {
+	a := o.Admin.withDefaults()
+
+	return Cluster{
+		Name:           AdminCluster,
+		ConnectTimeout: Duration(o.ConnectTimeout),
+		LoadAssignment: &ClusterLoadAssignment{
+			ClusterName: AdminCluster,
+			Endpoints: []LocalityLbEndpoints{{
+				LbEndpoints: []LbEndpoint{{
+					Endpoint: Endpoint{Address: socketAddress(a.Address, a.Port)},
+				}},
+			}},
+		},
+	}
+}
+
+// statsSinks returns the statsd sinks, then the DogStatsD ones.
+func statsSinks(o Options) []StatsSink {
+	var sinks []StatsSink
+	for _, address := range o.StatsdAddresses {
+		sinks = append(sinks, StatsSink{
+			Name:        statsSinkStatsd,
+			TypedConfig: StatsdSink{Type: typeStatsdSink, Address: sinkAddress(address)},
+		})
+	}
+	for _, address := range o.DogStatsdAddresses {
+		sinks = append(sinks, StatsSink{
+			Name:        statsSinkDogStatsd,
+			TypedConfig: StatsdSink{Type: typeDogStatsdSink, Address: sinkAddress(address)},
+		})
+	}
+	return sinks
+}
+
+func sinkAddress(address string) Address {
+	host, port, _ := net.SplitHostPort(address)
+	p, _ := strconv.Atoi(port)
+	return socketAddress(host, p)
+}
@@ -0,0 +1,461 @@
+// Package envoy builds the Envoy bootstrap configuration of the proxy sidecar out of
+// typed structs. Only the subset of the Envoy v3 API used by the buildpack is modelled;
+// the yaml tags follow the field names of the Envoy API.
+package envoy
+
+import (
+	"gopkg.in/yaml.v2"
+	"strconv"
+	"time"
+)
+
+const (
+	typeHTTPConnectionManager    = "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager"
+	typeFileAccessLog            = "type.googleapis.com/envoy.extensions.access_loggers.file.v3.FileAccessLog"
+	typeDynamicForwardProxy      = "type.googleapis.com/envoy.extensions.filters.http.dynamic_forward_proxy.v3.FilterConfig"
+	typeDynamicForwardProxyRoute = "type.googleapis.com/envoy.extensions.filters.http.dynamic_forward_proxy.v3.PerRouteConfig"
+	typeDynamicForwardCluster    = "type.googleapis.com/envoy.extensions.clusters.dynamic_forward_proxy.v3.ClusterConfig"
+	typeRouter                   = "type.googleapis.com/envoy.extensions.filters.http.router.v3.Router"
+	typeUpstreamTLSContext       = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext"
+	typeDownstreamTLSContext     = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext"
+	typeRBAC                     = "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC"
+	typeHTTPProtocolOptions      = "type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+	typeTCPProxy                 = "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy"
+	typeStatsdSink               = "type.googleapis.com/envoy.config.metrics.v3.StatsdSink"
+	typeDogStatsdSink            = "type.googleapis.com/envoy.config.metrics.v3.DogStatsdSink"
+
+	filterHTTPConnectionManager = "envoy.filters.network.http_connection_manager"
+	filterTCPProxy              = "envoy.filters.network.tcp_proxy"
+	filterDynamicForwardProxy   = "envoy.filters.http.dynamic_forward_proxy"
+	filterRouter                = "envoy.filters.http.router"
+	filterRBAC                  = "envoy.filters.http.rbac"
+	accessLoggerStdout          = "envoy.access_loggers.stdout"
+	clusterDynamicForwardProxy  = "envoy.clusters.dynamic_forward_proxy"
+	transportSocketTLS          = "envoy.transport_sockets.tls"
+	statsSinkStatsd             = "envoy.stat_sinks.statsd"
+	statsSinkDogStatsd          = "envoy.stat_sinks.dog_statsd"
+
+	extensionHTTPProtocolOptions = "envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+)
+
+type Bootstrap struct {
+	Node            Node            `yaml:"node"`
+	Admin           *Admin          `yaml:"admin,omitempty"`
+	StatsSinks      []StatsSink     `yaml:"stats_sinks,omitempty"`
+	LayeredRuntime  *LayeredRuntime `yaml:"layered_runtime,omitempty"`
+	StaticResources StaticResources `yaml:"static_resources"`
+}
+
+type Node struct {
+	ID      string `yaml:"id"`
+	Cluster string `yaml:"cluster"`
+}
+
+type Admin struct {
+	Address Address `yaml:"address"`
+}
+
+// StatsSink holds one of the stats sink configs, such as StatsdSink.
+type StatsSink struct {
+	Name        string      `yaml:"name"`
+	TypedConfig interface{} `yaml:"typed_config"`
+}
+
+// StatsdSink is the config of both the statsd and the DogStatsD sinks.
+type StatsdSink struct {
+	Type    string  `yaml:"@type"`
+	Address Address `yaml:"address"`
+}
+
+type LayeredRuntime struct {
+	Layers []RuntimeLayer `yaml:"layers"`
+}
+
+type RuntimeLayer struct {
+	Name        string                 `yaml:"name"`
+	StaticLayer map[string]interface{} `yaml:"static_layer"`
+}
+
+type StaticResources struct {
+	Listeners []Listener `yaml:"listeners"`
+	Clusters  []Cluster  `yaml:"clusters"`
+}
+
+type Listener struct {
+	Name         string        `yaml:"name"`
+	Address      Address       `yaml:"address"`
+	FilterChains []FilterChain `yaml:"filter_chains"`
+}
+
+type Address struct {
+	SocketAddress *SocketAddress `yaml:"socket_address,omitempty"`
+	Pipe          *Pipe          `yaml:"pipe,omitempty"`
+}
+
+type SocketAddress struct {
+	Address    string `yaml:"address"`
+	PortValue  int    `yaml:"port_value"`
+	IPv4Compat bool   `yaml:"ipv4_compat,omitempty"`
+}
+
+type Pipe struct {
+	Path string `yaml:"path"`
+}
+
+type FilterChain struct {
+	Filters         []NetworkFilter  `yaml:"filters"`
+	TransportSocket *TransportSocket `yaml:"transport_socket,omitempty"`
+}
+
+// NetworkFilter holds one of the network filter configs, such as HTTPConnectionManager.
+type NetworkFilter struct {
+	Name        string      `yaml:"name"`
+	TypedConfig interface{} `yaml:"typed_config"`
+}
+
+type HTTPConnectionManager struct {
+	Type                        string                      `yaml:"@type"`
+	SchemeHeaderTransformation  *SchemeHeaderTransformation `yaml:"scheme_header_transformation,omitempty"`
+	CommonHTTPProtocolOptions   *HTTPProtocolOptions        `yaml:"common_http_protocol_options,omitempty"`
+	ForwardClientCertDetails    string                      `yaml:"forward_client_cert_details,omitempty"`
+	SetCurrentClientCertDetails *ClientCertDetails          `yaml:"set_current_client_cert_details,omitempty"`
+	CodecType                   string                      `yaml:"codec_type"`
+	NormalizePath               bool                        `yaml:"normalize_path,omitempty"`
+	MergeSlashes                bool                        `yaml:"merge_slashes,omitempty"`
+	PathWithEscapedSlashes      string                      `yaml:"path_with_escaped_slashes_action,omitempty"`
+	AccessLog                   []AccessLog                 `yaml:"access_log,omitempty"`
+	StatPrefix                  string                      `yaml:"stat_prefix"`
+	RouteConfig                 RouteConfiguration          `yaml:"route_config"`
+	HTTPFilters                 []HTTPFilter                `yaml:"http_filters"`
+}
+
+type TCPProxy struct {
+	Type       string      `yaml:"@type"`
+	StatPrefix string      `yaml:"stat_prefix"`
+	Cluster    string      `yaml:"cluster"`
+	AccessLog  []AccessLog `yaml:"access_log,omitempty"`
+}
+
+type SchemeHeaderTransformation struct {
+	SchemeToOverwrite string `yaml:"scheme_to_overwrite"`
+}
+
+type HTTPProtocolOptions struct {
+	IdleTimeout Duration `yaml:"idle_timeout"`
+}
+
+type ClientCertDetails struct {
+	URI   bool `yaml:"uri,omitempty"`
+	Cert  bool `yaml:"cert,omitempty"`
+	Chain bool `yaml:"chain,omitempty"`
+}
+
+type AccessLog struct {
+	Name        string      `yaml:"name"`
+	TypedConfig interface{} `yaml:"typed_config"`
+}
+
+type FileAccessLog struct {
+	Type   string `yaml:"@type"`
+	Path   string `yaml:"path"`
+	Format string `yaml:"format,omitempty"`
+}
+
+type RouteConfiguration struct {
+	Name         string        `yaml:"name"`
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
+}
+
+type VirtualHost struct {
+	Name                   string              `yaml:"name"`
+	Domains                []string            `yaml:"domains"`
+	RequireTLS             string              `yaml:"require_tls,omitempty"`
+	Routes                 []Route             `yaml:"routes"`
+	RequestHeadersToAdd    []HeaderValueOption `yaml:"request_headers_to_add,omitempty"`
+	RequestHeadersToRemove []string            `yaml:"request_headers_to_remove,omitempty"`
+}
+
+type HeaderValueOption struct {
+	Header HeaderValue `yaml:"header"`
+	Append bool        `yaml:"append"`
+}
+
+type HeaderValue struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+type Route struct {
+	Match                RouteMatch             `yaml:"match"`
+	Route                *RouteAction           `yaml:"route,omitempty"`
+	DirectResponse       *DirectResponseAction  `yaml:"direct_response,omitempty"`
+	TypedPerFilterConfig map[string]interface{} `yaml:"typed_per_filter_config,omitempty"`
+}
+
+type RouteMatch struct {
+	Prefix string `yaml:"prefix,omitempty"`
+	Path   string `yaml:"path,omitempty"`
+}
+
+type RouteAction struct {
+	Cluster     string       `yaml:"cluster"`
+	Timeout     *Duration    `yaml:"timeout,omitempty"`
+	RetryPolicy *RetryPolicy `yaml:"retry_policy,omitempty"`
+}
+
+type RetryPolicy struct {
+	RetryOn    string `yaml:"retry_on"`
+	NumRetries int    `yaml:"num_retries,omitempty"`
+}
+
+type DirectResponseAction struct {
+	Status int         `yaml:"status"`
+	Body   *DataSource `yaml:"body,omitempty"`
+}
+
+// HTTPFilter holds one of the HTTP filter configs, such as Router.
+type HTTPFilter struct {
+	Name        string      `yaml:"name"`
+	TypedConfig interface{} `yaml:"typed_config"`
+}
+
+type DynamicForwardProxyFilter struct {
+	Type           string         `yaml:"@type"`
+	DNSCacheConfig DNSCacheConfig `yaml:"dns_cache_config"`
+}
+
+type DynamicForwardProxyPerRoute struct {
+	Type string `yaml:"@type"`
+}
+
+type Router struct {
+	Type string `yaml:"@type"`
+}
+
+type RBAC struct {
+	Type  string     `yaml:"@type"`
+	Rules *RBACRules `yaml:"rules,omitempty"`
+}
+
+type RBACRules struct {
+	Action   string                `yaml:"action"`
+	Policies map[string]RBACPolicy `yaml:"policies"`
+}
+
+type RBACPolicy struct {
+	Permissions []Permission `yaml:"permissions"`
+	Principals  []Principal  `yaml:"principals"`
+}
+
+type Permission struct {
+	Any     bool         `yaml:"any,omitempty"`
+	URLPath *PathMatcher `yaml:"url_path,omitempty"`
+}
+
+type Principal struct {
+	Any           bool           `yaml:"any,omitempty"`
+	Authenticated *Authenticated `yaml:"authenticated,omitempty"`
+}
+
+type Authenticated struct {
+	PrincipalName StringMatcher `yaml:"principal_name"`
+}
+
+type PathMatcher struct {
+	Path StringMatcher `yaml:"path"`
+}
+
+type StringMatcher struct {
+	Exact  string `yaml:"exact,omitempty"`
+	Prefix string `yaml:"prefix,omitempty"`
+}
+
+type DNSCacheConfig struct {
+	Name            string `yaml:"name"`
+	DNSLookupFamily string `yaml:"dns_lookup_family"`
+}
+
+type Cluster struct {
+	Name                          string                 `yaml:"name"`
+	ConnectTimeout                Duration               `yaml:"connect_timeout"`
+	Type                          string                 `yaml:"type,omitempty"`
+	DNSLookupFamily               string                 `yaml:"dns_lookup_family,omitempty"`
+	CircuitBreakers               *CircuitBreakers       `yaml:"circuit_breakers,omitempty"`
+	HTTP2ProtocolOptions          *struct{}              `yaml:"http2_protocol_options,omitempty"`
+	LbPolicy                      string                 `yaml:"lb_policy,omitempty"`
+	ClusterType                   *CustomClusterType     `yaml:"cluster_type,omitempty"`
+	LoadAssignment                *ClusterLoadAssignment `yaml:"load_assignment,omitempty"`
+	TransportSocket               *TransportSocket       `yaml:"transport_socket,omitempty"`
+	TypedExtensionProtocolOptions map[string]interface{} `yaml:"typed_extension_protocol_options,omitempty"`
+}
+
+type CircuitBreakers struct {
+	Thresholds []Thresholds `yaml:"thresholds"`
+}
+
+type Thresholds struct {
+	MaxConnections     int `yaml:"max_connections,omitempty"`
+	MaxPendingRequests int `yaml:"max_pending_requests,omitempty"`
+	MaxRequests        int `yaml:"max_requests,omitempty"`
+}
+
+// HTTPProtocolOptionsExtension holds the upstream HTTP options of a cluster.
+type HTTPProtocolOptionsExtension struct {
+	Type                        string                       `yaml:"@type"`
+	UpstreamHTTPProtocolOptions *UpstreamHTTPProtocolOptions `yaml:"upstream_http_protocol_options,omitempty"`
+	ExplicitHTTPConfig          *ExplicitHTTPConfig          `yaml:"explicit_http_config,omitempty"`
+}
+
+type UpstreamHTTPProtocolOptions struct {
+	AutoSNI           bool `yaml:"auto_sni,omitempty"`
+	AutoSANValidation bool `yaml:"auto_san_validation,omitempty"`
+}
+
+type ExplicitHTTPConfig struct {
+	HTTPProtocolOptions *struct{} `yaml:"http_protocol_options,omitempty"`
+}
+
+type CustomClusterType struct {
+	Name        string      `yaml:"name"`
+	TypedConfig interface{} `yaml:"typed_config"`
+}
+
+type DynamicForwardProxyCluster struct {
+	Type           string         `yaml:"@type"`
+	DNSCacheConfig DNSCacheConfig `yaml:"dns_cache_config"`
+}
+
+type ClusterLoadAssignment struct {
+	ClusterName string                `yaml:"cluster_name"`
+	Endpoints   []LocalityLbEndpoints `yaml:"endpoints"`
+}
+
+type LocalityLbEndpoints struct {
+	LbEndpoints []LbEndpoint `yaml:"lb_endpoints"`
+}
+
+type LbEndpoint struct {
+	Endpoint Endpoint `yaml:"endpoint"`
+}
+
+type Endpoint struct {
+	Address Address `yaml:"address"`
+}
+
+type TransportSocket struct {
+	Name        string      `yaml:"name"`
+	TypedConfig interface{} `yaml:"typed_config"`
+}
+
+type UpstreamTLSContext struct {
+	Type             string           `yaml:"@type"`
+	SNI              string           `yaml:"sni,omitempty"`
+	CommonTLSContext CommonTLSContext `yaml:"common_tls_context"`
+}
+
+type DownstreamTLSContext struct {
+	Type                     string           `yaml:"@type"`
+	CommonTLSContext         CommonTLSContext `yaml:"common_tls_context"`
+	RequireClientCertificate bool             `yaml:"require_client_certificate"`
+}
+
+type CommonTLSContext struct {
+	ValidationContext                *CertificateValidationContext         `yaml:"validation_context,omitempty"`
+	TLSCertificateSDSSecretConfigs   []SDSSecretConfig                     `yaml:"tls_certificate_sds_secret_configs,omitempty"`
+	ValidationContextSDSSecretConfig *SDSSecretConfig                      `yaml:"validation_context_sds_secret_config,omitempty"`
+	CombinedValidationContext        *CombinedCertificateValidationContext `yaml:"combined_validation_context,omitempty"`
+}
+
+type CertificateValidationContext struct {
+	TrustedCA                 *DataSource             `yaml:"trusted_ca,omitempty"`
+	MatchTypedSubjectAltNames []SubjectAltNameMatcher `yaml:"match_typed_subject_alt_names,omitempty"`
+}
+
+// CombinedCertificateValidationContext validates the peer against the bundle fetched
+// over SDS and the static checks of the default validation context.
+type CombinedCertificateValidationContext struct {
+	DefaultValidationContext         CertificateValidationContext `yaml:"default_validation_context"`
+	ValidationContextSDSSecretConfig SDSSecretConfig              `yaml:"validation_context_sds_secret_config"`
+}
+
+type SubjectAltNameMatcher struct {
+	SanType string        `yaml:"san_type"`
+	Matcher StringMatcher `yaml:"matcher"`
+}
+
+type DataSource struct {
+	Filename     string `yaml:"filename,omitempty"`
+	InlineString string `yaml:"inline_string,omitempty"`
+}
+
+// SDSSecretConfig requests the secret `Name` from the SDS server.
+type SDSSecretConfig struct {
+	Name      string       `yaml:"name"`
+	SDSConfig ConfigSource `yaml:"sds_config"`
+}
+
+type ConfigSource struct {
+	ResourceAPIVersion string          `yaml:"resource_api_version"`
+	APIConfigSource    APIConfigSource `yaml:"api_config_source"`
+}
+
+type APIConfigSource struct {
+	APIType                   string        `yaml:"api_type"`
+	SetNodeOnFirstMessageOnly bool          `yaml:"set_node_on_first_message_only"`
+	TransportAPIVersion       string        `yaml:"transport_api_version"`
+	GRPCServices              []GRPCService `yaml:"grpc_services"`
+}
+
+type GRPCService struct {
+	EnvoyGRPC EnvoyGRPC `yaml:"envoy_grpc"`
+}
+
+type EnvoyGRPC struct {
+	ClusterName string `yaml:"cluster_name"`
+}
+
+// Duration is marshaled the way Envoy expects durations, as seconds such as `0.25s`.
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return strconv.FormatFloat(time.Duration(d).Seconds(), 'f', -1, 64) + "s", nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// YAML validates the bootstrap and marshals it.
+func (b *Bootstrap) YAML() ([]byte, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(b)
+}
+
+func (b *Bootstrap) Listener(name string) *Listener {
+	for i := range b.StaticResources.Listeners {
+		if b.StaticResources.Listeners[i].Name == name {
+			return &b.StaticResources.Listeners[i]
+		}
+	}
+	return nil
+}
+
+func (b *Bootstrap) Cluster(name string) *Cluster {
+	for i := range b.StaticResources.Clusters {
+		if b.StaticResources.Clusters[i].Name == name {
+			return &b.StaticResources.Clusters[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,421 @@
+package envoy
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply/spiffeid"
+	"net"
+	"time"
+)
+
+const (
+	OutboundListener   = "outbound_proxy"
+	SpireAgentCluster  = "spire_agent"
+	ServiceMTLSCluster = "service_mtls"
+
+	dnsCacheName = "dynamic_forward_proxy_cache_config"
+
+	accessLogFormat = "[%START_TIME%] \"%REQ(:METHOD)% %REQ(X-ENVOY-ORIGINAL-PATH?:PATH)% %PROTOCOL%\" %RESPONSE_CODE% %RESPONSE_FLAGS% %BYTES_RECEIVED% %BYTES_SENT% %DURATION% %RESP(X-ENVOY-UPSTREAM-SERVICE-TIME)% \"%REQ(X-FORWARDED-FOR)%\" \"%REQ(USER-AGENT)%\" \"%REQ(X-REQUEST-ID)%\" \"%REQ(:AUTHORITY)%\" \"%UPSTREAM_HOST%\" \"%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%\"\n"
+)
+
+// DNSLookupFamilies are the values Envoy accepts for dns_lookup_family.
+var DNSLookupFamilies = []string{"AUTO", "V4_ONLY", "V6_ONLY", "V4_PREFERRED", "ALL"}
+
+// Options are the tunable values of the bootstrap. The zero values of the numeric
+// fields and of the timeouts are replaced by the defaults of DefaultOptions.
+type Options struct {
+	// SpiffeID is the SVID the proxy presents, requested from the spire agent over SDS.
+	SpiffeID string
+	// SpireAgentSocket is the path of the spire agent's workload API socket.
+	SpireAgentSocket string
+	// TrustDomain is the trust domain of the app.
+	TrustDomain string
+	// AppPort is the port the app listens on; no listener of the proxy may bind it. The
+	// launch command replaces it with $PORT in the app cluster, see AppPortRewrite.
+	AppPort int
+	// Egress are the policies of the destination hosts; DefaultEgress is the mode of the
+	// hosts without a policy.
+	Egress        []EgressPolicy
+	DefaultEgress string
+	// SystemCAFile is the bundle the tls upstreams are validated against.
+	SystemCAFile string
+	// TCPTunnels add a tcp listener each on TCPTunnelAddress.
+	TCPTunnels       []TCPTunnel
+	TCPTunnelAddress string
+
+	// ListenerAddress is the address the outbound listener binds: 127.0.0.1 or ::1 keep
+	// it off the network interface of the container, :: binds IPv6 and IPv4.
+	ListenerAddress                string
+	ListenerPort                   int
+	ConnectionLimit                int
+	GlobalDownstreamMaxConnections int
+	DNSLookupFamily                string
+	IdleTimeout                    time.Duration
+	ConnectTimeout                 time.Duration
+
+	// Resiliency applies to every destination; Destinations override it for the hosts of
+	// the egress policies and of the tcp tunnels.
+	Resiliency   Resiliency
+	Destinations map[string]Resiliency
+
+	// Ingress adds the inbound listener when set.
+	Ingress *IngressOptions
+	// Admin adds the admin interface when set.
+	Admin *AdminOptions
+	// StatsdAddresses and DogStatsdAddresses are the `ip:port` of the stats sinks.
+	StatsdAddresses    []string
+	DogStatsdAddresses []string
+}
+
+func DefaultOptions() Options {
+	return Options{
+		SpireAgentSocket:               "/tmp/spire-agent/public/api.sock",
+		AppPort:                        8080,
+		ListenerAddress:                "0.0.0.0",
+		ListenerPort:                   8000,
+		ConnectionLimit:                10000,
+		GlobalDownstreamMaxConnections: 50000,
+		DNSLookupFamily:                "V4_ONLY",
+		DefaultEgress:                  EgressDeny,
+		SystemCAFile:                   "/etc/ssl/certs/ca-certificates.crt",
+		TCPTunnelAddress:               "127.0.0.1",
+		IdleTimeout:                    time.Second,
+		ConnectTimeout:                 250 * time.Millisecond,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.SpireAgentSocket == "" {
+		o.SpireAgentSocket = d.SpireAgentSocket
+	}
+	if o.AppPort == 0 {
+		o.AppPort = d.AppPort
+	}
+	if o.ListenerAddress == "" {
+		o.ListenerAddress = d.ListenerAddress
+	}
+	if o.ListenerPort == 0 {
+		o.ListenerPort = d.ListenerPort
+	}
+	if o.ConnectionLimit == 0 {
+		o.ConnectionLimit = d.ConnectionLimit
+	}
+	if o.GlobalDownstreamMaxConnections == 0 {
+		o.GlobalDownstreamMaxConnections = d.GlobalDownstreamMaxConnections
+	}
+	if o.DNSLookupFamily == "" {
+		o.DNSLookupFamily = d.DNSLookupFamily
+	}
+	if o.DefaultEgress == "" {
+		o.DefaultEgress = d.DefaultEgress
+	}
+	if o.SystemCAFile == "" {
+		o.SystemCAFile = d.SystemCAFile
+	}
+	if o.TCPTunnelAddress == "" {
+		o.TCPTunnelAddress = d.TCPTunnelAddress
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = d.IdleTimeout
+	}
+	if o.ConnectTimeout == 0 {
+		o.ConnectTimeout = d.ConnectTimeout
+	}
+	return o
+}
+
+// Validate checks the values of the options; unset values are valid, as they are
+// replaced by the defaults.
+func (o Options) Validate() []string {
+	var problems []string
+
+	o = o.withDefaults()
+	if o.SpiffeID == "" {
+		problems = append(problems, "the SPIFFE ID of the proxy is not set")
+	}
+	if err := spiffeid.ValidateTrustDomain(o.TrustDomain); err != nil {
+		problems = append(problems, fmt.Sprintf("envoy trust domain `%s` is invalid: %v", o.TrustDomain, err))
+	}
+	hosts := map[string]struct{}{}
+	for _, p := range o.Egress {
+		if _, ok := hosts[p.Host]; ok {
+			problems = append(problems, fmt.Sprintf("envoy egress has several policies for `%s`", p.Host))
+		}
+		hosts[p.Host] = struct{}{}
+		if err := p.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy egress %v", err))
+		}
+	}
+	if !isEgressMode(o.DefaultEgress) {
+		problems = append(problems, fmt.Sprintf("envoy default egress `%s` is not one of %v", o.DefaultEgress, EgressModes))
+	}
+	if net.ParseIP(o.ListenerAddress) == nil {
+		problems = append(problems, fmt.Sprintf("envoy listener address `%s` is not an IP address", o.ListenerAddress))
+	}
+	if o.ListenerPort < 1 || o.ListenerPort > 65535 {
+		problems = append(problems, fmt.Sprintf("envoy listener port %d is out of range 1-65535", o.ListenerPort))
+	}
+	if net.ParseIP(o.TCPTunnelAddress) == nil {
+		problems = append(problems, fmt.Sprintf("envoy tcp tunnel address `%s` is not an IP address", o.TCPTunnelAddress))
+	}
+	if o.AppPort < 1 || o.AppPort > 65535 {
+		problems = append(problems, fmt.Sprintf("envoy app port %d is out of range 1-65535", o.AppPort))
+	}
+	for _, t := range o.TCPTunnels {
+		if err := t.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy %v", err))
+		}
+	}
+	problems = append(problems, o.portCollisions()...)
+	if o.ConnectionLimit < 0 {
+		problems = append(problems, fmt.Sprintf("envoy connection limit %d is negative", o.ConnectionLimit))
+	}
+	if o.GlobalDownstreamMaxConnections < 0 {
+		problems = append(problems, fmt.Sprintf("envoy global downstream max connections %d is negative", o.GlobalDownstreamMaxConnections))
+	}
+	if !isDNSLookupFamily(o.DNSLookupFamily) {
+		problems = append(problems, fmt.Sprintf("envoy dns lookup family `%s` is not one of %v", o.DNSLookupFamily, DNSLookupFamilies))
+	}
+	if o.IdleTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("envoy idle timeout %s is negative", o.IdleTimeout))
+	}
+	if o.ConnectTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("envoy connect timeout %s is negative", o.ConnectTimeout))
+	}
+	for _, p := range o.Resiliency.Validate() {
+		problems = append(problems, "envoy "+p)
+	}
+	for _, host := range sortedDestinations(o.Destinations) {
+		if !o.isDestination(host) {
+			problems = append(problems, fmt.Sprintf("envoy destination `%s` has neither an egress policy nor a tcp tunnel", host))
+		}
+		for _, p := range o.Destinations[host].Validate() {
+			problems = append(problems, fmt.Sprintf("envoy destination `%s`: %s", host, p))
+		}
+	}
+	if o.Ingress != nil {
+		problems = append(problems, o.Ingress.Validate()...)
+	}
+	if o.Admin != nil {
+		problems = append(problems, o.Admin.Validate()...)
+	}
+	for _, address := range o.StatsdAddresses {
+		if err := validateSinkAddress(address); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy statsd sink %v", err))
+		}
+	}
+	for _, address := range o.DogStatsdAddresses {
+		if err := validateSinkAddress(address); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy dogstatsd sink %v", err))
+		}
+	}
+	return problems
+}
+
+// portCollisions reports the listeners binding the port of the app or the port of
+// another listener, whatever their addresses.
+func (o Options) portCollisions() []string {
+	var problems []string
+
+	ports := map[int]string{o.AppPort: "the app"}
+	use := func(port int, name string) {
+		if other, ok := ports[port]; ok {
+			problems = append(problems, fmt.Sprintf("port %d of %s is already used by %s", port, name, other))
+			return
+		}
+		ports[port] = name
+	}
+
+	use(o.ListenerPort, "the envoy listener")
+	if o.Ingress != nil {
+		use(o.Ingress.withDefaults().Port, "the envoy ingress")
+	}
+	for _, t := range o.tunnels() {
+		use(t.LocalPort, "the envoy tcp tunnel to `"+t.upstream()+"`")
+	}
+	if o.Admin != nil {
+		a := o.Admin.withDefaults()
+		use(a.Port, "the envoy admin interface")
+		if a.PrometheusPort != 0 {
+			use(a.PrometheusPort, "the envoy prometheus listener")
+		}
+	}
+	return problems
+}
+
+func isDNSLookupFamily(family string) bool {
+	for _, f := range DNSLookupFamilies {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// New builds the bootstrap of the outbound proxy: HTTP requests to the listener are
+// forwarded to the requested host according to its egress policy, over mTLS presenting
+// the SVID of the app, over TLS, in plaintext or not at all. The TCP tunnels forward the
+// connections to their local port over mTLS. With Ingress set, it also fronts the app
+// with the inbound listener; with Admin set, it serves the admin interface and the
+// Prometheus listener.
+func New(o Options) *Bootstrap {
+	o = o.withDefaults()
+
+	b := &Bootstrap{
+		Node: Node{ID: "proxy-with-spire", Cluster: "spire"},
+		StaticResources: StaticResources{
+			Listeners: []Listener{outboundListener(o)},
+			Clusters:  append([]Cluster{spireAgentCluster(o)}, egressClusters(o)...),
+		},
+	}
+	for _, t := range o.tunnels() {
+		b.StaticResources.Listeners = append(b.StaticResources.Listeners, tunnelListener(o, t))
+	}
+	b.StaticResources.Clusters = append(b.StaticResources.Clusters, tunnelClusters(o)...)
+	if o.Ingress != nil {
+		b.StaticResources.Listeners = append(b.StaticResources.Listeners, inboundListener(o))
+		b.StaticResources.Clusters = append(b.StaticResources.Clusters, localAppCluster(o))
+	}
+	if o.Admin != nil {
+		b.Admin = admin(o)
+		if o.Admin.PrometheusPort != 0 {
+			b.StaticResources.Listeners = append(b.StaticResources.Listeners, prometheusListener(o))
+			b.StaticResources.Clusters = append(b.StaticResources.Clusters, adminCluster(o))
+		}
+	}
+	b.StatsSinks = statsSinks(o)
+	b.LayeredRuntime = runtime(b, o)
+
+	return b
+}
+
+func outboundListener(o Options) Listener {
+	var virtualHosts []VirtualHost
+	for _, p := range o.egress() {
+		virtualHosts = append(virtualHosts, egressVirtualHost(o, p))
+	}
+	virtualHosts = append(virtualHosts, defaultVirtualHost(o))
+
+	var httpFilters []HTTPFilter
+	if o.usesDynamicForwardProxy() {
+		httpFilters = append(httpFilters, HTTPFilter{
+			Name: filterDynamicForwardProxy,
+			TypedConfig: DynamicForwardProxyFilter{
+				Type:           typeDynamicForwardProxy,
+				DNSCacheConfig: dnsCacheConfig(o),
+			},
+		})
+	}
+	httpFilters = append(httpFilters, HTTPFilter{
+		Name:        filterRouter,
+		TypedConfig: Router{Type: typeRouter},
+	})
+
+	return Listener{
+		Name:    OutboundListener,
+		Address: socketAddress(o.ListenerAddress, o.ListenerPort),
+		FilterChains: []FilterChain{{
+			Filters: []NetworkFilter{{
+				Name: filterHTTPConnectionManager,
+				TypedConfig: HTTPConnectionManager{
+					Type:                       typeHTTPConnectionManager,
+					SchemeHeaderTransformation: &SchemeHeaderTransformation{SchemeToOverwrite: "https"},
+					CommonHTTPProtocolOptions:  &HTTPProtocolOptions{IdleTimeout: Duration(o.IdleTimeout)},
+					ForwardClientCertDetails:   "sanitize_set",
+					SetCurrentClientCertDetails: &ClientCertDetails{
+						URI:   true,
+						Cert:  true,
+						Chain: true,
+					},
+					CodecType:  "auto",
+					AccessLog:  []AccessLog{stdoutAccessLog(accessLogFormat)},
+					StatPrefix: "ingress_http",
+					RouteConfig: RouteConfiguration{
+						Name:         "local_route",
+						VirtualHosts: virtualHosts,
+					},
+					HTTPFilters: httpFilters,
+				},
+			}},
+		}},
+	}
+}
+
+func spireAgentCluster(o Options) Cluster {
+	return Cluster{
+		Name:                 SpireAgentCluster,
+		ConnectTimeout:       Duration(o.ConnectTimeout),
+		HTTP2ProtocolOptions: &struct{}{},
+		LoadAssignment: &ClusterLoadAssignment{
+			ClusterName: SpireAgentCluster,
+			Endpoints: []LocalityLbEndpoints{{
+				LbEndpoints: []LbEndpoint{{
+					Endpoint: Endpoint{Address: Address{Pipe: &Pipe{Path: o.SpireAgentSocket}}},
+				}},
+			}},
+		},
+	}
+}
+
+// SDSSecret requests the secret `name` from the spire agent.
+func SDSSecret(name string) SDSSecretConfig {
+	return SDSSecretConfig{
+		Name: name,
+		SDSConfig: ConfigSource{
+			ResourceAPIVersion: "V3",
+			APIConfigSource: APIConfigSource{
+				APIType:                   "GRPC",
+				SetNodeOnFirstMessageOnly: true,
+				TransportAPIVersion:       "V3",
+				GRPCServices:              []GRPCService{{EnvoyGRPC: EnvoyGRPC{ClusterName: SpireAgentCluster}}},
+			},
+		},
+	}
+}
+
+func stdoutAccessLog(format string) AccessLog {
+	return AccessLog{
+		Name: accessLoggerStdout,
+		TypedConfig: FileAccessLog{
+			Type:   typeFileAccessLog,
+			Path:   "/dev/stdout",
+			Format: format,
+		},
+	}
+}
+
+func dnsCacheConfig(o Options) DNSCacheConfig {
+	return DNSCacheConfig{Name: dnsCacheName, DNSLookupFamily: o.DNSLookupFamily}
+}
+
+// socketAddress returns the address of a listener or of an endpoint. The IPv6 wildcard
+// address also accepts the IPv4 connections, so that :: binds both stacks.
+func socketAddress(address string, port int) Address {
+	return Address{SocketAddress: &SocketAddress{
+		Address:    address,
+		PortValue:  port,
+		IPv4Compat: address == "::",
+	}}
+}
+
+// runtime limits the connections of every listener of the bootstrap.
+func runtime(b *Bootstrap, o Options) *LayeredRuntime {
+	listeners := map[string]interface{}{}
+	for _, l := range b.StaticResources.Listeners {
+		listeners[l.Name] = map[string]interface{}{"connection_limit": o.ConnectionLimit}
+	}
+
+	return &LayeredRuntime{
+		Layers: []RuntimeLayer{{
+			Name: "static_layer_0",
+			StaticLayer: map[string]interface{}{
+				"envoy": map[string]interface{}{
+					"resource_limits": map[string]interface{}{"listener": listeners},
+				},
+				"overload": map[string]interface{}{
+					"global_downstream_max_connections": o.GlobalDownstreamMaxConnections,
+				},
+			},
+		}},
+	}
+}
@@ -0,0 +1,359 @@
+package envoy
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply/spiffeid"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// EgressMTLS presents the SVID of the app and checks the SPIFFE ID of the upstream.
+	EgressMTLS = "mtls"
+	// EgressTLS validates the upstream against the system CAs, as for public APIs.
+	EgressTLS = "tls"
+	// EgressPlaintext forwards the requests without TLS.
+	EgressPlaintext = "plaintext"
+	// EgressDeny answers the requests with 403.
+	EgressDeny = "deny"
+
+	UpstreamTLSCluster       = "upstream_tls"
+	UpstreamPlaintextCluster = "upstream_plaintext"
+
+	sanTypeURI = "URI"
+)
+
+// EgressModes are the modes of an egress policy.
+var EgressModes = []string{EgressMTLS, EgressTLS, EgressPlaintext, EgressDeny}
+
+var hostPatternRegexp = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?))*$`)
+
+// EgressPolicy is how the requests to a destination host are forwarded.
+type EgressPolicy struct {
+	// Host is a host name, or a pattern such as `*.example.org`.
+	Host string
+	Mode string
+	// SpiffeID is the SPIFFE ID expected from an mtls upstream; it is empty when any
+	// workload of TrustDomain is accepted.
+	SpiffeID string
+	// TrustDomain is the trust domain of an mtls upstream; it is empty for the trust
+	// domain of the app.
+	TrustDomain string
+}
+
+// ParseEgressPolicy parses the policy of host, one of `deny`, `tls`, `plaintext`, `mtls`
+// or `mtls:<expected>`. The expected identity is either a SPIFFE ID such as
+// `spiffe://example.org/api` or a trust domain such as `example.org`; without it, any
+// workload of the trust domain of the app is accepted.
+func ParseEgressPolicy(host, policy string) (EgressPolicy, error) {
+	mode, expected, _ := strings.Cut(policy, ":")
+	p := EgressPolicy{Host: host, Mode: mode}
+
+	if mode == EgressMTLS && strings.HasPrefix(expected, "spiffe://") {
+		id, err := spiffeid.FromString(expected)
+		if err != nil {
+			return EgressPolicy{}, fmt.Errorf("SPIFFE ID `%s` of `%s` is invalid: %v", expected, host, err)
+		}
+		p.SpiffeID, p.TrustDomain = id.String(), id.TrustDomain()
+	} else if expected != "" {
+		p.TrustDomain = expected
+	}
+
+	if err := p.Validate(); err != nil {
+		return EgressPolicy{}, err
+	}
+	return p, nil
+}
+
+// ParseUpstream parses the identity expected from an mtls upstream; it is the same as
+// the policy `mtls:<expected>`.
+func ParseUpstream(host, expected string) (EgressPolicy, error) {
+	if expected == "" {
+		return EgressPolicy{}, fmt.Errorf("upstream `%s` has no expected SPIFFE ID or trust domain", host)
+	}
+	return ParseEgressPolicy(host, EgressMTLS+":"+expected)
+}
+
+// Validate checks the host pattern, the mode and the expected identity of the policy.
+func (p EgressPolicy) Validate() error {
+	if net.ParseIP(p.Host) == nil && (!hostPatternRegexp.MatchString(p.Host) || len(p.Host) > 253) {
+		return fmt.Errorf("`%s` is neither a host name, an IP address nor a pattern such as `*.example.org`", p.Host)
+	}
+	if !isEgressMode(p.Mode) {
+		return fmt.Errorf("policy `%s` of `%s` is not one of %v", p.Mode, p.Host, EgressModes)
+	}
+	if p.Mode != EgressMTLS {
+		if p.SpiffeID != "" || p.TrustDomain != "" {
+			return fmt.Errorf("policy `%s` of `%s` takes no expected identity", p.Mode, p.Host)
+		}
+		return nil
+	}
+
+	if p.TrustDomain != "" {
+		if err := spiffeid.ValidateTrustDomain(p.TrustDomain); err != nil {
+			return fmt.Errorf("trust domain `%s` of `%s` is invalid: %v", p.TrustDomain, p.Host, err)
+		}
+	}
+	if p.SpiffeID != "" {
+		id, err := spiffeid.FromString(p.SpiffeID)
+		if err != nil {
+			return fmt.Errorf("SPIFFE ID `%s` of `%s` is invalid: %v", p.SpiffeID, p.Host, err)
+		}
+		if p.TrustDomain != "" && !id.MemberOf(p.TrustDomain) {
+			return fmt.Errorf("SPIFFE ID `%s` of `%s` is not in trust domain `%s`", p.SpiffeID, p.Host, p.TrustDomain)
+		}
+	}
+	return nil
+}
+
+func isEgressMode(mode string) bool {
+	for _, m := range EgressModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// egress returns the policies sorted by host, with the trust domain of the app filled in
+// for the mtls policies without one.
+func (o Options) egress() []EgressPolicy {
+	policies := append([]EgressPolicy(nil), o.Egress...)
+	sort.SliceStable(policies, func(i, j int) bool {
+		return policies[i].Host < policies[j].Host
+	})
+	for i := range policies {
+		if policies[i].Mode == EgressMTLS && policies[i].TrustDomain == "" {
+			policies[i].TrustDomain = o.TrustDomain
+		}
+	}
+	return policies
+}
+
+// usesDynamicForwardProxy reports whether any route goes to a dynamic forward proxy
+// cluster, which needs the dynamic forward proxy filter.
+func (o Options) usesDynamicForwardProxy() bool {
+	if o.DefaultEgress != EgressDeny {
+		return true
+	}
+	for _, p := range o.Egress {
+		if p.Mode != EgressDeny {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterName returns the cluster of the policy. The mtls policies checking a SPIFFE ID
+// or a trust domain have a cluster each, as do the policies with their own circuit
+// breakers; the others share one per mode.
+func (o Options) clusterName(p EgressPolicy) string {
+	host := strings.ReplaceAll(p.Host, "*", "wildcard")
+	if p.Mode != EgressMTLS && o.hasOwnCircuitBreakers(p.Host) {
+		return "upstream_" + p.Mode + "_" + host
+	}
+	switch p.Mode {
+	case EgressTLS:
+		return UpstreamTLSCluster
+	case EgressPlaintext:
+		return UpstreamPlaintextCluster
+	}
+	return "upstream_" + host
+}
+
+func (o Options) hasOwnCircuitBreakers(host string) bool {
+	d, ok := o.Destinations[host]
+	return ok && d.hasCircuitBreakers()
+}
+
+// sanMatcher matches the URI SAN of the upstream certificate against the expected SPIFFE
+// ID, or against any ID of the trust domain.
+func (p EgressPolicy) sanMatcher() SubjectAltNameMatcher {
+	if p.SpiffeID != "" {
+		return SubjectAltNameMatcher{SanType: sanTypeURI, Matcher: StringMatcher{Exact: p.SpiffeID}}
+	}
+	return SubjectAltNameMatcher{SanType: sanTypeURI, Matcher: StringMatcher{Prefix: "spiffe://" + p.TrustDomain + "/"}}
+}
+
+// egressVirtualHost matches the host with any port. A pattern can't carry a second
+// wildcard for the port, so the requests to a pattern with an explicit port are handled
+// by the default policy. IPv6 addresses are bracketed, as in the Host header.
+func egressVirtualHost(o Options, p EgressPolicy) VirtualHost {
+	host := p.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	domains := []string{host}
+	if !strings.HasPrefix(host, "*") {
+		domains = append(domains, host+":*")
+	}
+
+	vh := VirtualHost{
+		Name:    "egress_" + strings.ReplaceAll(p.Host, "*", "wildcard"),
+		Domains: domains,
+		Routes:  []Route{egressRoute(p.Mode, o.clusterName(p), o.resiliency(p.Host))},
+	}
+	if p.Mode == EgressMTLS {
+		vh.RequireTLS = "ALL"
+	}
+	return vh
+}
+
+// defaultVirtualHost handles the requests to the hosts without a policy.
+func defaultVirtualHost(o Options) VirtualHost {
+	vh := VirtualHost{
+		Name:    OutboundListener,
+		Domains: []string{"*"},
+	}
+
+	switch o.DefaultEgress {
+	case EgressMTLS:
+		vh.RequireTLS = "ALL"
+		vh.Routes = []Route{egressRoute(EgressMTLS, ServiceMTLSCluster, o.Resiliency)}
+	case EgressTLS:
+		vh.Routes = []Route{egressRoute(EgressTLS, UpstreamTLSCluster, o.Resiliency)}
+	case EgressPlaintext:
+		vh.Routes = []Route{egressRoute(EgressPlaintext, UpstreamPlaintextCluster, o.Resiliency)}
+	default:
+		vh.Routes = []Route{egressRoute(EgressDeny, "", o.Resiliency)}
+	}
+	return vh
+}
+
+func egressRoute(mode, cluster string, r Resiliency) Route {
+	if mode == EgressDeny {
+		return Route{
+			Match: RouteMatch{Prefix: "/"},
+			DirectResponse: &DirectResponseAction{
+				Status: 403,
+				Body:   &DataSource{InlineString: "egress to this host is denied\n"},
+			},
+		}
+	}
+
+	action := &RouteAction{Cluster: cluster}
+	r.apply(action)
+
+	return Route{
+		Match: RouteMatch{Prefix: "/"},
+		Route: action,
+		TypedPerFilterConfig: map[string]interface{}{
+			filterDynamicForwardProxy: DynamicForwardProxyPerRoute{Type: typeDynamicForwardProxyRoute},
+		},
+	}
+}
+
+// egressClusters returns the clusters the egress policies and the default policy route
+// to, each once.
+func egressClusters(o Options) []Cluster {
+	var clusters []Cluster
+	added := map[string]struct{}{}
+	add := func(name string, build func() Cluster) {
+		if _, ok := added[name]; !ok {
+			added[name] = struct{}{}
+			clusters = append(clusters, build())
+		}
+	}
+
+	policies := o.egress()
+	policies = append(policies, EgressPolicy{Mode: o.DefaultEgress})
+	for _, p := range policies {
+		p := p
+		switch {
+		case p.Mode == EgressMTLS && p.Host == "":
+			add(ServiceMTLSCluster, func() Cluster { return serviceMTLSCluster(o) })
+		case p.Mode == EgressMTLS:
+			add(o.clusterName(p), func() Cluster { return mtlsCluster(o, p) })
+		case p.Mode == EgressTLS:
+			add(o.clusterName(p), func() Cluster { return tlsCluster(o, p) })
+		case p.Mode == EgressPlaintext:
+			add(o.clusterName(p), func() Cluster { return plaintextCluster(o, p) })
+		}
+	}
+	return clusters
+}
+
+func mtlsCluster(o Options, p EgressPolicy) Cluster {
+	tls := mtlsContext(o, p)
+	return dynamicForwardCluster(o, o.clusterName(p), p.Host, &tls)
+}
+
+// mtlsContext presents the SVID of the app and validates the upstream against the bundle
+// of its trust domain and the expected SPIFFE ID of the policy.
+func mtlsContext(o Options, p EgressPolicy) CommonTLSContext {
+	return CommonTLSContext{
+		TLSCertificateSDSSecretConfigs: []SDSSecretConfig{SDSSecret(o.SpiffeID)},
+		CombinedValidationContext: &CombinedCertificateValidationContext{
+			DefaultValidationContext: CertificateValidationContext{
+				MatchTypedSubjectAltNames: []SubjectAltNameMatcher{p.sanMatcher()},
+			},
+			ValidationContextSDSSecretConfig: SDSSecret("spiffe://" + p.TrustDomain),
+		},
+	}
+}
+
+// serviceMTLSCluster forwards the mtls requests to the hosts without a policy; the
+// upstream is only validated against the bundle of the trust domain of the app.
+func serviceMTLSCluster(o Options) Cluster {
+	bundle := SDSSecret("spiffe://" + o.TrustDomain)
+
+	return dynamicForwardCluster(o, ServiceMTLSCluster, "", &CommonTLSContext{
+		TLSCertificateSDSSecretConfigs:   []SDSSecretConfig{SDSSecret(o.SpiffeID)},
+		ValidationContextSDSSecretConfig: &bundle,
+	})
+}
+
+// tlsCluster validates the upstream against the system CAs; the SNI and the checked
+// SAN are the requested host. The policy is the default one for the shared cluster.
+func tlsCluster(o Options, p EgressPolicy) Cluster {
+	c := dynamicForwardCluster(o, o.clusterName(p), p.Host, &CommonTLSContext{
+		ValidationContext: &CertificateValidationContext{
+			TrustedCA: &DataSource{Filename: o.SystemCAFile},
+		},
+	})
+	c.TypedExtensionProtocolOptions = map[string]interface{}{
+		extensionHTTPProtocolOptions: HTTPProtocolOptionsExtension{
+			Type: typeHTTPProtocolOptions,
+			UpstreamHTTPProtocolOptions: &UpstreamHTTPProtocolOptions{
+				AutoSNI:           true,
+				AutoSANValidation: true,
+			},
+			ExplicitHTTPConfig: &ExplicitHTTPConfig{HTTPProtocolOptions: &struct{}{}},
+		},
+	}
+	return c
+}
+
+func plaintextCluster(o Options, p EgressPolicy) Cluster {
+	return dynamicForwardCluster(o, o.clusterName(p), p.Host, nil)
+}
+
+// dynamicForwardCluster returns a dynamic forward proxy cluster with the circuit
+// breakers of host; the upstream connections use TLS when tls is set.
+func dynamicForwardCluster(o Options, name, host string, tls *CommonTLSContext) Cluster {
+	c := Cluster{
+		Name:            name,
+		ConnectTimeout:  Duration(o.ConnectTimeout),
+		CircuitBreakers: o.resiliency(host).circuitBreakers(),
+		LbPolicy:        "CLUSTER_PROVIDED",
+		ClusterType: &CustomClusterType{
+			Name: clusterDynamicForwardProxy,
+			TypedConfig: DynamicForwardProxyCluster{
+				Type:           typeDynamicForwardCluster,
+				DNSCacheConfig: dnsCacheConfig(o),
+			},
+		},
+	}
+	if tls != nil {
+		c.TransportSocket = &TransportSocket{
+			Name: transportSocketTLS,
+			TypedConfig: UpstreamTLSContext{
+				Type:             typeUpstreamTLSContext,
+				CommonTLSContext: *tls,
+			},
+		}
+	}
+	return c
+}
@@ -0,0 +1,510 @@
+package envoy
+
+import (
+	"flag"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func testOptions() Options {
+	o := DefaultOptions()
+	o.SpiffeID = "spiffe://example.org/app"
+	o.TrustDomain = "example.org"
+	o.Egress = []EgressPolicy{{Host: "api.example.org", Mode: EgressMTLS, SpiffeID: "spiffe://example.org/api", TrustDomain: "example.org"}}
+	return o
+}
+
+func mustParseEgress(t *testing.T, host, policy string) EgressPolicy {
+	p, err := ParseEgressPolicy(host, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func mustParseTunnel(t *testing.T, upstream, tunnel string) TCPTunnel {
+	tun, err := ParseTCPTunnel(upstream, tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tun
+}
+
+func TestBootstrapYAML(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *Options)
+	}{
+		{
+			name:   "default",
+			modify: func(o *Options) {},
+		},
+		{
+			name: "tuned",
+			modify: func(o *Options) {
+				o.ListenerPort = 9000
+				o.ConnectionLimit = 100
+				o.GlobalDownstreamMaxConnections = 500
+				o.DNSLookupFamily = "V4_PREFERRED"
+				o.IdleTimeout = 90 * time.Second
+			},
+		},
+		{
+			name: "no_egress",
+			modify: func(o *Options) {
+				o.Egress = nil
+			},
+		},
+		{
+			name: "egress_policies",
+			modify: func(o *Options) {
+				o.Egress = append(o.Egress,
+					mustParseEgress(t, "*.partner.example", "mtls:partner.example"),
+					mustParseEgress(t, "billing.example.org", "mtls"),
+					mustParseEgress(t, "api.github.com", "tls"),
+					mustParseEgress(t, "*.googleapis.com", "tls"),
+					mustParseEgress(t, "legacy.internal", "plaintext"),
+					mustParseEgress(t, "admin.example.org", "deny"),
+				)
+				o.DefaultEgress = EgressMTLS
+			},
+		},
+		{
+			name: "default_egress_tls",
+			modify: func(o *Options) {
+				o.Egress = []EgressPolicy{mustParseEgress(t, "blocked.example.com", "deny")}
+				o.DefaultEgress = EgressTLS
+			},
+		},
+		{
+			name: "tcp_tunnels",
+			modify: func(o *Options) {
+				o.TCPTunnels = []TCPTunnel{
+					mustParseTunnel(t, "mq.example.org:5671", "15671"),
+					mustParseTunnel(t, "db.example.org:5432", "15432:spiffe://example.org/db"),
+				}
+			},
+		},
+		{
+			name: "resiliency",
+			modify: func(o *Options) {
+				o.ConnectTimeout = 2 * time.Second
+				o.Egress = append(o.Egress,
+					mustParseEgress(t, "api.github.com", "tls"),
+					mustParseEgress(t, "slow.partner.example", "tls"),
+				)
+				o.DefaultEgress = EgressTLS
+				o.TCPTunnels = []TCPTunnel{mustParseTunnel(t, "db.example.org:5432", "15432")}
+				o.Resiliency = Resiliency{
+					RequestTimeout: 10 * time.Second,
+					RetryOn:        []string{"5xx", "reset"},
+					MaxRetries:     2,
+					MaxConnections: 512,
+				}
+				o.Destinations = map[string]Resiliency{
+					"api.example.org":      {RequestTimeout: 30 * time.Second, MaxRetries: 4},
+					"slow.partner.example": {RetryOn: []string{"connect-failure"}, MaxPendingRequests: 10},
+					"db.example.org":       {MaxConnections: 20},
+				}
+			},
+		},
+		{
+			name: "dual_stack",
+			modify: func(o *Options) {
+				o.ListenerAddress = "::"
+				o.DNSLookupFamily = "ALL"
+				o.TCPTunnelAddress = "::1"
+				o.TCPTunnels = []TCPTunnel{mustParseTunnel(t, "[2001:db8::10]:5432", "15432")}
+				o.Ingress = &IngressOptions{Address: "::"}
+			},
+		},
+		{
+			name: "admin",
+			modify: func(o *Options) {
+				o.Admin = &AdminOptions{PrometheusPort: 9102}
+				o.StatsdAddresses = []string{"127.0.0.1:8125"}
+				o.DogStatsdAddresses = []string{"[::1]:8126"}
+			},
+		},
+		{
+			name: "ingress",
+			modify: func(o *Options) {
+				o.Ingress = &IngressOptions{}
+			},
+		},
+		{
+			name: "ingress_rbac",
+			modify: func(o *Options) {
+				o.AppPort = 8081
+				o.Ingress = &IngressOptions{
+					Port:                9443,
+					IdentityHeader:      IdentityHeaderSpiffeID,
+					AllowedSpiffeIDs:    []string{"spiffe://example.org/frontend", "spiffe://example.org/batch/*"},
+					AllowedPathPrefixes: []string{"/health"},
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOptions()
+			tt.modify(&o)
+
+			got, err := New(o).YAML()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "bootstrap", tt.name+".yaml")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("bootstrap mismatch; run with -update to regenerate\n got:\n%s\nwant:\n%s", got, want)
+			}
+
+			var parsed map[string]interface{}
+			if err := yaml.Unmarshal(got, &parsed); err != nil {
+				t.Fatalf("generated bootstrap doesn't parse: %v", err)
+			}
+		})
+	}
+}
+
+func TestDuration(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		250 * time.Millisecond: "0.25s",
+		time.Second:            "1s",
+		90 * time.Second:       "90s",
+	} {
+		data, err := yaml.Marshal(Duration(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(data)); got != want {
+			t.Errorf("%s: got %s, want %s", d, got, want)
+		}
+
+		var back Duration
+		if err := yaml.Unmarshal(data, &back); err != nil || time.Duration(back) != d {
+			t.Errorf("%s: round trip gave %s, %v", d, time.Duration(back), err)
+		}
+	}
+}
+
+func TestBootstrapValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(b *Bootstrap)
+		err    string
+	}{
+		{
+			name: "unknown route cluster",
+			modify: func(b *Bootstrap) {
+				b.StaticResources.Clusters = b.StaticResources.Clusters[:1]
+			},
+			err: "refers to unknown cluster `upstream_api.example.org`",
+		},
+		{
+			name: "unknown SDS cluster",
+			modify: func(b *Bootstrap) {
+				b.StaticResources.Clusters = b.StaticResources.Clusters[1:]
+			},
+			err: "refers to unknown cluster `spire_agent`",
+		},
+		{
+			name: "duplicated cluster",
+			modify: func(b *Bootstrap) {
+				b.StaticResources.Clusters = append(b.StaticResources.Clusters, b.StaticResources.Clusters[0])
+			},
+			err: "duplicated cluster `spire_agent`",
+		},
+		{
+			name: "duplicated listener address",
+			modify: func(b *Bootstrap) {
+				l := b.StaticResources.Listeners[0]
+				l.Name = "other"
+				b.StaticResources.Listeners = append(b.StaticResources.Listeners, l)
+			},
+			err: "both bind 0.0.0.0:8000",
+		},
+		{
+			name: "router not last",
+			modify: func(b *Bootstrap) {
+				hcm := b.StaticResources.Listeners[0].FilterChains[0].Filters[0].TypedConfig.(HTTPConnectionManager)
+				hcm.HTTPFilters = hcm.HTTPFilters[:1]
+				b.StaticResources.Listeners[0].FilterChains[0].Filters[0].TypedConfig = hcm
+			},
+			err: "must be the router",
+		},
+		{
+			name: "dns cache mismatch",
+			modify: func(b *Bootstrap) {
+				c := b.Cluster("upstream_api.example.org")
+				dfp := c.ClusterType.TypedConfig.(DynamicForwardProxyCluster)
+				dfp.DNSCacheConfig.DNSLookupFamily = "ALL"
+				c.ClusterType.TypedConfig = dfp
+			},
+			err: "differs from the one of the dynamic forward proxy cluster",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New(testOptions())
+			tt.modify(b)
+
+			err := b.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing `%s`, got %v", tt.err, err)
+			}
+			if _, err := b.YAML(); err == nil {
+				t.Error("expected YAML to refuse an invalid bootstrap")
+			}
+		})
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	o := testOptions()
+	if problems := o.Validate(); len(problems) != 0 {
+		t.Errorf("unexpected problems: %q", problems)
+	}
+
+	o.ListenerPort = 70000
+	o.ListenerAddress = "localhost"
+	o.DNSLookupFamily = "V5_ONLY"
+	o.IdleTimeout = -time.Second
+	o.SpiffeID = ""
+	o.Egress = append(o.Egress,
+		EgressPolicy{Host: "bad host", Mode: EgressTLS},
+		EgressPolicy{Host: "api.example.org", Mode: EgressTLS},
+		EgressPolicy{Host: "legacy.internal", Mode: EgressPlaintext, TrustDomain: "example.org"},
+	)
+	o.DefaultEgress = "allow"
+	if problems := o.Validate(); len(problems) != 9 {
+		t.Errorf("expected 9 problems, got %q", problems)
+	}
+}
+
+func TestIngressOptionsValidate(t *testing.T) {
+	in := IngressOptions{
+		Port:                70000,
+		IdentityHeader:      "x-caller",
+		AllowedSpiffeIDs:    []string{"spiffe://example.org/ok/*", "example.org/frontend"},
+		AllowedPathPrefixes: []string{"health"},
+	}
+
+	problems := in.Validate()
+	for _, want := range []string{"out of range", "identity header", "`example.org/frontend`", "`health`"} {
+		if !containsProblem(problems, want) {
+			t.Errorf("expected a problem containing `%s`, got %q", want, problems)
+		}
+	}
+	if len(problems) != 4 {
+		t.Errorf("expected 4 problems, got %q", problems)
+	}
+}
+
+func TestIngressListenerPortCollision(t *testing.T) {
+	o := testOptions()
+	o.Ingress = &IngressOptions{Port: o.ListenerPort}
+
+	if err := New(o).Validate(); err == nil || !strings.Contains(err.Error(), "both bind") {
+		t.Errorf("expected the listeners to collide, got %v", err)
+	}
+	if problems := o.Validate(); len(problems) != 1 || !strings.Contains(problems[0], "already used by the envoy listener") {
+		t.Errorf("expected the ingress port to collide, got %q", problems)
+	}
+
+	o.Ingress = &IngressOptions{Port: o.AppPort}
+	if problems := o.Validate(); len(problems) != 1 || !strings.Contains(problems[0], "already used by the app") {
+		t.Errorf("expected the ingress port to collide with the app, got %q", problems)
+	}
+}
+
+func TestAdminOptionsValidate(t *testing.T) {
+	o := testOptions()
+	o.Admin = &AdminOptions{Address: "0.0.0.0", Port: o.ListenerPort, PrometheusPort: o.AppPort}
+	o.StatsdAddresses = []string{"statsd.example.org:8125"}
+	o.DogStatsdAddresses = []string{"127.0.0.1"}
+
+	problems := o.Validate()
+	for _, want := range []string{
+		"admin address `0.0.0.0` is not a loopback address",
+		"port 8000 of the envoy admin interface is already used by the envoy listener",
+		"port 8080 of the envoy prometheus listener is already used by the app",
+		"statsd sink host of `statsd.example.org:8125`",
+		"dogstatsd sink `127.0.0.1` is not an ip:port",
+	} {
+		if !containsProblem(problems, want) {
+			t.Errorf("expected a problem containing `%s`, got %q", want, problems)
+		}
+	}
+	if len(problems) != 5 {
+		t.Errorf("expected 5 problems, got %q", problems)
+	}
+}
+
+// TestIngressPathNormalization checks that a path such as `/health/../admin`, `//admin`
+// or `/health%2F..%2Fadmin` is normalized before the RBAC filter matches the allowed
+// `/health` prefix.
+func TestIngressPathNormalization(t *testing.T) {
+	o := testOptions()
+	o.Ingress = &IngressOptions{AllowedPathPrefixes: []string{"/health"}}
+	b := New(o)
+
+	chain := &b.Listener(InboundListener).FilterChains[0]
+	hcm := chain.Filters[0].TypedConfig.(HTTPConnectionManager)
+	if !hcm.NormalizePath || !hcm.MergeSlashes || hcm.PathWithEscapedSlashes != "UNESCAPE_AND_REDIRECT" {
+		t.Fatalf("inbound paths are not normalized: %+v", hcm)
+	}
+
+	hcm.NormalizePath = false
+	chain.Filters[0].TypedConfig = hcm
+	if err := b.Validate(); err == nil || !strings.Contains(err.Error(), "matches paths that are not normalized") {
+		t.Errorf("expected the unnormalized paths to be refused, got %v", err)
+	}
+}
+
+func TestParseEgressPolicy(t *testing.T) {
+	tests := []struct {
+		host, policy string
+		want         EgressPolicy
+		err          bool
+	}{
+		{host: "api.example.org", policy: "mtls:spiffe://example.org/api", want: EgressPolicy{Host: "api.example.org", Mode: EgressMTLS, SpiffeID: "spiffe://example.org/api", TrustDomain: "example.org"}},
+		{host: "*.example.org", policy: "mtls:example.org", want: EgressPolicy{Host: "*.example.org", Mode: EgressMTLS, TrustDomain: "example.org"}},
+		{host: "api.example.org", policy: "mtls", want: EgressPolicy{Host: "api.example.org", Mode: EgressMTLS}},
+		{host: "api.github.com", policy: "tls", want: EgressPolicy{Host: "api.github.com", Mode: EgressTLS}},
+		{host: "legacy", policy: "plaintext", want: EgressPolicy{Host: "legacy", Mode: EgressPlaintext}},
+		{host: "api.*.org", policy: "tls", err: true},
+		{host: "api.example.org", policy: "mtls:spiffe://example.org/api/", err: true},
+		{host: "api.example.org", policy: "tls:example.org", err: true},
+		{host: "api.example.org", policy: "allow", err: true},
+		{host: "api.example.org", policy: "", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseEgressPolicy(tt.host, tt.policy)
+		if (err != nil) != tt.err {
+			t.Errorf("%s=%s: unexpected error %v", tt.host, tt.policy, err)
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("%s=%s: got %+v, want %+v", tt.host, tt.policy, got, tt.want)
+		}
+	}
+
+	if _, err := ParseUpstream("api.example.org", ""); err == nil {
+		t.Error("expected an upstream without expected identity to fail")
+	}
+}
+
+func TestParseTCPTunnel(t *testing.T) {
+	tests := []struct {
+		upstream, tunnel string
+		want             TCPTunnel
+		err              bool
+	}{
+		{upstream: "db.example.org:5432", tunnel: "15432:spiffe://example.org/db", want: TCPTunnel{LocalPort: 15432, Host: "db.example.org", Port: 5432, SpiffeID: "spiffe://example.org/db", TrustDomain: "example.org"}},
+		{upstream: "mq.partner.example:5671", tunnel: "15671:partner.example", want: TCPTunnel{LocalPort: 15671, Host: "mq.partner.example", Port: 5671, TrustDomain: "partner.example"}},
+		{upstream: "cache.example.org:6379", tunnel: "16379", want: TCPTunnel{LocalPort: 16379, Host: "cache.example.org", Port: 6379}},
+		{upstream: "db.example.org", tunnel: "15432", err: true},
+		{upstream: "db.example.org:http", tunnel: "15432", err: true},
+		{upstream: "*.example.org:5432", tunnel: "15432", err: true},
+		{upstream: "db.example.org:5432", tunnel: "db", err: true},
+		{upstream: "db.example.org:5432", tunnel: "70000", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTCPTunnel(tt.upstream, tt.tunnel)
+		if (err != nil) != tt.err {
+			t.Errorf("%s=%s: unexpected error %v", tt.upstream, tt.tunnel, err)
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("%s=%s: got %+v, want %+v", tt.upstream, tt.tunnel, got, tt.want)
+		}
+	}
+}
+
+func TestTCPTunnelPortCollision(t *testing.T) {
+	o := testOptions()
+	o.TCPTunnels = []TCPTunnel{
+		mustParseTunnel(t, "db.example.org:5432", "15432"),
+		mustParseTunnel(t, "replica.example.org:5432", "15432"),
+		mustParseTunnel(t, "mq.example.org:5671", "8000"),
+	}
+
+	problems := o.Validate()
+	if len(problems) != 2 {
+		t.Errorf("expected 2 problems, got %q", problems)
+	}
+}
+
+func TestParseResiliency(t *testing.T) {
+	got, err := ParseResiliency("request_timeout=30s; retry_on=5xx|reset;max_retries=3;max_connections=100;max_pending_requests=10;max_requests=200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Resiliency{
+		RequestTimeout:     30 * time.Second,
+		RetryOn:            []string{"5xx", "reset"},
+		MaxRetries:         3,
+		MaxConnections:     100,
+		MaxPendingRequests: 10,
+		MaxRequests:        200,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, spec := range []string{"request_timeout=30", "max_retries", "retries=3", "max_requests=many"} {
+		if _, err := ParseResiliency(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestResiliencyValidate(t *testing.T) {
+	o := testOptions()
+	o.Resiliency = Resiliency{RetryOn: []string{"5xx", "timeout"}, MaxRetries: -1}
+	o.Destinations = map[string]Resiliency{
+		"api.example.org":     {RequestTimeout: -time.Second},
+		"unknown.example.org": {MaxRequests: 10},
+	}
+
+	problems := o.Validate()
+	for _, want := range []string{"retry condition `timeout`", "max retries -1", "destination `api.example.org`: request timeout", "`unknown.example.org` has neither"} {
+		if !containsProblem(problems, want) {
+			t.Errorf("expected a problem containing `%s`, got %q", want, problems)
+		}
+	}
+	if len(problems) != 4 {
+		t.Errorf("expected 4 problems, got %q", problems)
+	}
+}
+
+// containsProblem reports whether one of the problems contains want.
+func containsProblem(problems []string, want string) bool {
+	for _, p := range problems {
+		if strings.Contains(p, want) {
+			return true
+		}
+	}
+	return false
+}
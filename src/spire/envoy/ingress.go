@@ -0,0 +1,217 @@
+package envoy
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply/spiffeid"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	InboundListener = "inbound_proxy"
+	LocalAppCluster = "local_app"
+
+	// IdentityHeaderXFCC passes the caller identity in the x-forwarded-client-cert header.
+	IdentityHeaderXFCC = "xfcc"
+	// IdentityHeaderSpiffeID passes the caller SPIFFE ID in the x-spiffe-id header.
+	IdentityHeaderSpiffeID = "x-spiffe-id"
+
+	policyAllowedCallers = "allowed-callers"
+	policyAllowedPaths   = "allowed-paths"
+)
+
+// IngressOptions configure the inbound listener, which terminates mTLS with the SVID of
+// the app and forwards the requests of the authorized callers to the app. The callers
+// are validated against the bundle of the trust domain of the app.
+//
+// The app cluster targets the app port of the options; the launch command of the proxy
+// replaces it with the $PORT of the app, see AppPortRewrite.
+type IngressOptions struct {
+	Address        string
+	Port           int
+	IdentityHeader string
+	// AllowedSpiffeIDs are the SPIFFE IDs of the callers allowed to call any path; an ID
+	// ending with `/*` allows every ID under it.
+	AllowedSpiffeIDs []string
+	// AllowedPathPrefixes are the paths any caller of the trust domain may call.
+	AllowedPathPrefixes []string
+}
+
+func (o IngressOptions) withDefaults() IngressOptions {
+	if o.Address == "" {
+		o.Address = "0.0.0.0"
+	}
+	if o.Port == 0 {
+		o.Port = 8443
+	}
+	if o.IdentityHeader == "" {
+		o.IdentityHeader = IdentityHeaderXFCC
+	}
+	return o
+}
+
+func (o IngressOptions) Validate() []string {
+	var problems []string
+
+	o = o.withDefaults()
+	if net.ParseIP(o.Address) == nil {
+		problems = append(problems, fmt.Sprintf("envoy ingress address `%s` is not an IP address", o.Address))
+	}
+	if o.Port < 1 || o.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("envoy ingress port %d is out of range 1-65535", o.Port))
+	}
+	if o.IdentityHeader != IdentityHeaderXFCC && o.IdentityHeader != IdentityHeaderSpiffeID {
+		problems = append(problems, fmt.Sprintf("envoy ingress identity header `%s` is not one of %s, %s",
+			o.IdentityHeader, IdentityHeaderXFCC, IdentityHeaderSpiffeID))
+	}
+	for _, id := range o.AllowedSpiffeIDs {
+		if _, err := spiffeid.FromString(strings.TrimSuffix(id, "/*")); err != nil {
+			problems = append(problems, fmt.Sprintf("allowed caller SPIFFE ID `%s` is invalid: %v", id, err))
+		}
+	}
+	for _, prefix := range o.AllowedPathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			problems = append(problems, fmt.Sprintf("allowed path prefix `%s` doesn't start with /", prefix))
+		}
+	}
+	return problems
+}
+
+func inboundListener(o Options) Listener {
+	in := o.Ingress.withDefaults()
+
+	// The paths are normalized before the RBAC filter matches the allowed prefixes, so
+	// that `/health/../admin`, `//admin` or `/health%2F..%2Fadmin` don't match `/health`.
+	hcm := HTTPConnectionManager{
+		Type:                   typeHTTPConnectionManager,
+		CodecType:              "auto",
+		NormalizePath:          true,
+		MergeSlashes:           true,
+		PathWithEscapedSlashes: "UNESCAPE_AND_REDIRECT",
+		AccessLog:              []AccessLog{stdoutAccessLog(accessLogFormat)},
+		StatPrefix:             "inbound_http",
+		RouteConfig: RouteConfiguration{
+			Name: "inbound_route",
+			VirtualHosts: []VirtualHost{{
+				Name:    InboundListener,
+				Domains: []string{"*"},
+				Routes: []Route{{
+					Match: RouteMatch{Prefix: "/"},
+					Route: &RouteAction{Cluster: LocalAppCluster},
+				}},
+			}},
+		},
+		HTTPFilters: []HTTPFilter{{
+			Name:        filterRouter,
+			TypedConfig: Router{Type: typeRouter},
+		}},
+	}
+
+	switch in.IdentityHeader {
+	case IdentityHeaderSpiffeID:
+		hcm.ForwardClientCertDetails = "sanitize"
+		vh := &hcm.RouteConfig.VirtualHosts[0]
+		vh.RequestHeadersToAdd = []HeaderValueOption{{
+			Header: HeaderValue{Key: IdentityHeaderSpiffeID, Value: "%DOWNSTREAM_PEER_URI_SAN%"},
+		}}
+	default:
+		hcm.ForwardClientCertDetails = "sanitize_set"
+		hcm.SetCurrentClientCertDetails = &ClientCertDetails{URI: true}
+	}
+
+	if rbac := ingressRBAC(in); rbac != nil {
+		hcm.HTTPFilters = append([]HTTPFilter{{Name: filterRBAC, TypedConfig: *rbac}}, hcm.HTTPFilters...)
+	}
+
+	bundle := SDSSecret("spiffe://" + o.TrustDomain)
+
+	return Listener{
+		Name:    InboundListener,
+		Address: socketAddress(in.Address, in.Port),
+		FilterChains: []FilterChain{{
+			Filters: []NetworkFilter{{
+				Name:        filterHTTPConnectionManager,
+				TypedConfig: hcm,
+			}},
+			TransportSocket: &TransportSocket{
+				Name: transportSocketTLS,
+				TypedConfig: DownstreamTLSContext{
+					Type: typeDownstreamTLSContext,
+					CommonTLSContext: CommonTLSContext{
+						TLSCertificateSDSSecretConfigs:   []SDSSecretConfig{SDSSecret(o.SpiffeID)},
+						ValidationContextSDSSecretConfig: &bundle,
+					},
+					RequireClientCertificate: true,
+				},
+			},
+		}},
+	}
+}
+
+// ingressRBAC allows the allowed callers to call any path, and any caller to call the
+// allowed paths. There is no RBAC filter when neither is set: every caller whose SVID
+// is validated against the bundle is allowed.
+func ingressRBAC(in IngressOptions) *RBAC {
+	policies := map[string]RBACPolicy{}
+
+	if len(in.AllowedSpiffeIDs) > 0 {
+		ids := append([]string(nil), in.AllowedSpiffeIDs...)
+		sort.Strings(ids)
+
+		principals := make([]Principal, 0, len(ids))
+		for _, id := range ids {
+			name := StringMatcher{Exact: id}
+			if strings.HasSuffix(id, "/*") {
+				name = StringMatcher{Prefix: strings.TrimSuffix(id, "*")}
+			}
+			principals = append(principals, Principal{Authenticated: &Authenticated{PrincipalName: name}})
+		}
+		policies[policyAllowedCallers] = RBACPolicy{
+			Permissions: []Permission{{Any: true}},
+			Principals:  principals,
+		}
+	}
+
+	if len(in.AllowedPathPrefixes) > 0 {
+		permissions := make([]Permission, 0, len(in.AllowedPathPrefixes))
+		for _, prefix := range in.AllowedPathPrefixes {
+			permissions = append(permissions, Permission{URLPath: &PathMatcher{Path: StringMatcher{Prefix: prefix}}})
+		}
+		policies[policyAllowedPaths] = RBACPolicy{
+			Permissions: permissions,
+			Principals:  []Principal{{Any: true}},
+		}
+	}
+
+	if len(policies) == 0 {
+		return nil
+	}
+	return &RBAC{
+		Type:  typeRBAC,
+		Rules: &RBACRules{Action: "ALLOW", Policies: policies},
+	}
+}
+
+func localAppCluster(o Options) Cluster {
+	return Cluster{
+		Name:           LocalAppCluster,
+		ConnectTimeout: Duration(o.ConnectTimeout),
+		LoadAssignment: &ClusterLoadAssignment{
+			ClusterName: LocalAppCluster,
+			Endpoints: []LocalityLbEndpoints{{
+				LbEndpoints: []LbEndpoint{{
+					Endpoint: Endpoint{Address: socketAddress("127.0.0.1", o.AppPort)},
+				}},
+			}},
+		},
+	}
+}
+
+// AppPortRewrite returns the shell command replacing the port of the app cluster in the
+// bootstrap file with $PORT, which is only known when the app is launched. The port of
+// the bootstrap is kept when $PORT isn't set.
+func AppPortRewrite(bootstrapFile string) string {
+	return fmt.Sprintf(`sed -i "/cluster_name: %s/,/port_value:/ s/port_value: \([0-9]*\)/port_value: ${PORT:-\1}/" %s`,
+		LocalAppCluster, bootstrapFile)
+}
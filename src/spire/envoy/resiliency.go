@@ -0,0 +1,190 @@
+package envoy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryConditions are the retry_on conditions of the retry policies.
+var RetryConditions = []string{"5xx", "gateway-error", "reset", "connect-failure", "retriable-4xx", "refused-stream"}
+
+// Resiliency are the timeouts, retries and circuit breakers of the requests to a
+// destination. The zero values keep the defaults of Envoy: a 15s request timeout, no
+// retries and thresholds of 1024.
+type Resiliency struct {
+	RequestTimeout time.Duration
+	// RetryOn are the conditions retried up to MaxRetries times, once when MaxRetries is
+	// zero; there are no retries when it is empty.
+	RetryOn    []string
+	MaxRetries int
+
+	MaxConnections     int
+	MaxPendingRequests int
+	MaxRequests        int
+}
+
+// ParseResiliency parses the `;` separated `key=value` overrides of a destination, such
+// as `request_timeout=30s;retry_on=5xx|reset;max_retries=3;max_connections=100`. The keys
+// are request_timeout, retry_on, whose conditions are separated by `|`, max_retries,
+// max_connections, max_pending_requests and max_requests.
+func ParseResiliency(spec string) (Resiliency, error) {
+	var r Resiliency
+	for _, field := range strings.Split(spec, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Resiliency{}, fmt.Errorf("`%s` is not a key=value pair", field)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "request_timeout":
+			r.RequestTimeout, err = time.ParseDuration(value)
+		case "retry_on":
+			r.RetryOn = strings.Split(value, "|")
+		case "max_retries":
+			r.MaxRetries, err = strconv.Atoi(value)
+		case "max_connections":
+			r.MaxConnections, err = strconv.Atoi(value)
+		case "max_pending_requests":
+			r.MaxPendingRequests, err = strconv.Atoi(value)
+		case "max_requests":
+			r.MaxRequests, err = strconv.Atoi(value)
+		default:
+			return Resiliency{}, fmt.Errorf("unknown key `%s`", key)
+		}
+		if err != nil {
+			return Resiliency{}, fmt.Errorf("value `%s` of `%s` is invalid: %v", value, key, err)
+		}
+	}
+	return r, nil
+}
+
+func (r Resiliency) Validate() []string {
+	var problems []string
+
+	if r.RequestTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("request timeout %s is negative", r.RequestTimeout))
+	}
+	for _, condition := range r.RetryOn {
+		if !isRetryCondition(condition) {
+			problems = append(problems, fmt.Sprintf("retry condition `%s` is not one of %v", condition, RetryConditions))
+		}
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"max retries", r.MaxRetries},
+		{"max connections", r.MaxConnections},
+		{"max pending requests", r.MaxPendingRequests},
+		{"max requests", r.MaxRequests},
+	} {
+		if limit.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s %d is negative", limit.name, limit.value))
+		}
+	}
+	return problems
+}
+
+func isRetryCondition(condition string) bool {
+	for _, c := range RetryConditions {
+		if c == condition {
+			return true
+		}
+	}
+	return false
+}
+
+// override returns r with the non-zero values of other.
+func (r Resiliency) override(other Resiliency) Resiliency {
+	if other.RequestTimeout != 0 {
+		r.RequestTimeout = other.RequestTimeout
+	}
+	if len(other.RetryOn) > 0 {
+		r.RetryOn = other.RetryOn
+	}
+	if other.MaxRetries != 0 {
+		r.MaxRetries = other.MaxRetries
+	}
+	if other.MaxConnections != 0 {
+		r.MaxConnections = other.MaxConnections
+	}
+	if other.MaxPendingRequests != 0 {
+		r.MaxPendingRequests = other.MaxPendingRequests
+	}
+	if other.MaxRequests != 0 {
+		r.MaxRequests = other.MaxRequests
+	}
+	return r
+}
+
+func (r Resiliency) hasCircuitBreakers() bool {
+	return r.MaxConnections != 0 || r.MaxPendingRequests != 0 || r.MaxRequests != 0
+}
+
+// resiliency returns the resiliency of the destination host: the defaults overridden by
+// the ones of the host. The empty host is the one of the shared clusters.
+func (o Options) resiliency(host string) Resiliency {
+	r := o.Resiliency
+	if d, ok := o.Destinations[host]; ok && host != "" {
+		r = r.override(d)
+	}
+	return r
+}
+
+// isDestination reports whether host has an egress policy or a tcp tunnel.
+func (o Options) isDestination(host string) bool {
+	for _, p := range o.Egress {
+		if p.Host == host {
+			return true
+		}
+	}
+	for _, t := range o.TCPTunnels {
+		if t.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedDestinations(destinations map[string]Resiliency) []string {
+	hosts := make([]string, 0, len(destinations))
+	for host := range destinations {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// apply sets the timeout and the retry policy of the route.
+func (r Resiliency) apply(route *RouteAction) {
+	if r.RequestTimeout > 0 {
+		timeout := Duration(r.RequestTimeout)
+		route.Timeout = &timeout
+	}
+	if len(r.RetryOn) > 0 {
+		route.RetryPolicy = &RetryPolicy{
+			RetryOn:    strings.Join(r.RetryOn, ","),
+			NumRetries: r.MaxRetries,
+		}
+	}
+}
+
+func (r Resiliency) circuitBreakers() *CircuitBreakers {
+	if !r.hasCircuitBreakers() {
+		return nil
+	}
+	return &CircuitBreakers{Thresholds: []Thresholds{{
+		MaxConnections:     r.MaxConnections,
+		MaxPendingRequests: r.MaxPendingRequests,
+		MaxRequests:        r.MaxRequests,
+	}}}
+}
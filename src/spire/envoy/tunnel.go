@@ -0,0 +1,166 @@
+package envoy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tcpAccessLogFormat = "[%START_TIME%] %RESPONSE_FLAGS% %BYTES_RECEIVED% %BYTES_SENT% %DURATION% \"%UPSTREAM_HOST%\" \"%DOWNSTREAM_REMOTE_ADDRESS_WITHOUT_PORT%\"\n"
+
+// TCPTunnel forwards the raw TCP connections to a local port over mTLS to an upstream,
+// for the clients that don't speak HTTP such as database drivers and message brokers.
+type TCPTunnel struct {
+	// LocalPort is the port the app connects to.
+	LocalPort int
+	Host      string
+	Port      int
+	// SpiffeID is the SPIFFE ID expected from the upstream; it is empty when any
+	// workload of TrustDomain is accepted.
+	SpiffeID string
+	// TrustDomain is the trust domain of the upstream; it is empty for the trust domain
+	// of the app.
+	TrustDomain string
+}
+
+// ParseTCPTunnel parses the tunnel to upstream, a `host:port`. The tunnel is either the
+// local port, or `<local port>:<expected>` where the expected identity is a SPIFFE ID
+// or a trust domain as in the mtls egress policies.
+func ParseTCPTunnel(upstream, tunnel string) (TCPTunnel, error) {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return TCPTunnel{}, fmt.Errorf("tcp tunnel upstream `%s` is not a host:port", upstream)
+	}
+	t := TCPTunnel{Host: host}
+	if t.Port, err = strconv.Atoi(port); err != nil {
+		return TCPTunnel{}, fmt.Errorf("port of tcp tunnel upstream `%s` is not a number", upstream)
+	}
+
+	localPort, expected, _ := strings.Cut(tunnel, ":")
+	if t.LocalPort, err = strconv.Atoi(strings.TrimSpace(localPort)); err != nil {
+		return TCPTunnel{}, fmt.Errorf("local port `%s` of tcp tunnel to `%s` is not a number", localPort, upstream)
+	}
+
+	policy := EgressMTLS
+	if expected != "" {
+		policy += ":" + expected
+	}
+	p, err := ParseEgressPolicy(host, policy)
+	if err != nil {
+		return TCPTunnel{}, err
+	}
+	t.SpiffeID, t.TrustDomain = p.SpiffeID, p.TrustDomain
+
+	if err := t.Validate(); err != nil {
+		return TCPTunnel{}, err
+	}
+	return t, nil
+}
+
+// Validate checks the ports, the host and the expected identity of the tunnel.
+func (t TCPTunnel) Validate() error {
+	if strings.Contains(t.Host, "*") {
+		return fmt.Errorf("tcp tunnel upstream `%s` must be a host name, not a pattern", t.Host)
+	}
+	if t.Port < 1 || t.Port > 65535 {
+		return fmt.Errorf("port %d of tcp tunnel upstream `%s` is out of range 1-65535", t.Port, t.Host)
+	}
+	if t.LocalPort < 1 || t.LocalPort > 65535 {
+		return fmt.Errorf("local port %d of tcp tunnel to `%s` is out of range 1-65535", t.LocalPort, t.Host)
+	}
+	return t.policy().Validate()
+}
+
+func (t TCPTunnel) policy() EgressPolicy {
+	return EgressPolicy{Host: t.Host, Mode: EgressMTLS, SpiffeID: t.SpiffeID, TrustDomain: t.TrustDomain}
+}
+
+func (t TCPTunnel) upstream() string {
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+func (t TCPTunnel) listenerName() string {
+	return fmt.Sprintf("tcp_tunnel_%d", t.LocalPort)
+}
+
+func (t TCPTunnel) clusterName() string {
+	return fmt.Sprintf("tcp_%s_%d", t.Host, t.Port)
+}
+
+// tunnels returns the tunnels sorted by local port, with the trust domain of the app
+// filled in for the tunnels without one.
+func (o Options) tunnels() []TCPTunnel {
+	tunnels := append([]TCPTunnel(nil), o.TCPTunnels...)
+	sort.SliceStable(tunnels, func(i, j int) bool {
+		return tunnels[i].LocalPort < tunnels[j].LocalPort
+	})
+	for i := range tunnels {
+		if tunnels[i].TrustDomain == "" {
+			tunnels[i].TrustDomain = o.TrustDomain
+		}
+	}
+	return tunnels
+}
+
+func tunnelListener(o Options, t TCPTunnel) Listener {
+	return Listener{
+		Name:    t.listenerName(),
+		Address: socketAddress(o.TCPTunnelAddress, t.LocalPort),
+		FilterChains: []FilterChain{{
+			Filters: []NetworkFilter{{
+				Name: filterTCPProxy,
+				TypedConfig: TCPProxy{
+					Type:       typeTCPProxy,
+					StatPrefix: t.listenerName(),
+					Cluster:    t.clusterName(),
+					AccessLog:  []AccessLog{stdoutAccessLog(tcpAccessLogFormat)},
+				},
+			}},
+		}},
+	}
+}
+
+// tunnelClusters returns the clusters of the upstreams of the tunnels, each once. The
+// upstreams are resolved with DNS; the SNI is the upstream host, unless it is an IP
+// address.
+func tunnelClusters(o Options) []Cluster {
+	var clusters []Cluster
+	added := map[string]struct{}{}
+	for _, t := range o.tunnels() {
+		if _, ok := added[t.clusterName()]; ok {
+			continue
+		}
+		added[t.clusterName()] = struct{}{}
+
+		var sni string
+		if net.ParseIP(t.Host) == nil {
+			sni = t.Host
+		}
+		clusters = append(clusters, Cluster{
+			Name:            t.clusterName(),
+			ConnectTimeout:  Duration(o.ConnectTimeout),
+			Type:            "LOGICAL_DNS",
+			DNSLookupFamily: o.DNSLookupFamily,
+			CircuitBreakers: o.resiliency(t.Host).circuitBreakers(),
+			LoadAssignment: &ClusterLoadAssignment{
+				ClusterName: t.clusterName(),
+				Endpoints: []LocalityLbEndpoints{{
+					LbEndpoints: []LbEndpoint{{
+						Endpoint: Endpoint{Address: socketAddress(t.Host, t.Port)},
+					}},
+				}},
+			},
+			TransportSocket: &TransportSocket{
+				Name: transportSocketTLS,
+				TypedConfig: UpstreamTLSContext{
+					Type:             typeUpstreamTLSContext,
+					SNI:              sni,
+					CommonTLSContext: mtlsContext(o, t.policy()),
+				},
+			},
+		})
+	}
+	return clusters
+}
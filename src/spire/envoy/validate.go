@@ -0,0 +1,188 @@
+package envoy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError holds every structural problem of a bootstrap.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid envoy configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate checks that the names of the listeners and of the clusters are unique, that
+// no two listeners, nor a listener and the admin interface, bind the same address, that
+// every referenced cluster exists and that the dns caches shared by the dynamic forward
+// proxy filters and clusters agree.
+func (b *Bootstrap) Validate() error {
+	verr := &ValidationError{}
+
+	clusters := map[string]struct{}{}
+	caches := map[string]DNSCacheConfig{}
+	for _, c := range b.StaticResources.Clusters {
+		if c.Name == "" {
+			verr.add("cluster without name")
+		} else if _, ok := clusters[c.Name]; ok {
+			verr.add("duplicated cluster `%s`", c.Name)
+		}
+		clusters[c.Name] = struct{}{}
+
+		if c.LoadAssignment == nil && c.ClusterType == nil {
+			verr.add("cluster `%s` has neither endpoints nor a cluster type", c.Name)
+		}
+		if c.ClusterType != nil {
+			if dfp, ok := c.ClusterType.TypedConfig.(DynamicForwardProxyCluster); ok {
+				if cache, ok := caches[dfp.DNSCacheConfig.Name]; ok && cache != dfp.DNSCacheConfig {
+					verr.add("dns cache `%s` of cluster `%s` differs from the other declarations of the cache", cache.Name, c.Name)
+				}
+				caches[dfp.DNSCacheConfig.Name] = dfp.DNSCacheConfig
+			}
+		}
+		b.checkTransportSocket(verr, c.TransportSocket, "cluster `"+c.Name+"`")
+	}
+
+	listeners := map[string]struct{}{}
+	addresses := map[string]string{}
+	if b.Admin != nil && b.Admin.Address.SocketAddress != nil {
+		sa := b.Admin.Address.SocketAddress
+		addresses[fmt.Sprintf("%s:%d", sa.Address, sa.PortValue)] = "admin"
+	}
+	for _, l := range b.StaticResources.Listeners {
+		if l.Name == "" {
+			verr.add("listener without name")
+		} else if _, ok := listeners[l.Name]; ok {
+			verr.add("duplicated listener `%s`", l.Name)
+		}
+		listeners[l.Name] = struct{}{}
+
+		if sa := l.Address.SocketAddress; sa != nil {
+			if sa.PortValue < 1 || sa.PortValue > 65535 {
+				verr.add("port %d of listener `%s` is out of range 1-65535", sa.PortValue, l.Name)
+			}
+			address := fmt.Sprintf("%s:%d", sa.Address, sa.PortValue)
+			if other, ok := addresses[address]; ok {
+				verr.add("listeners `%s` and `%s` both bind %s", other, l.Name, address)
+			}
+			addresses[address] = l.Name
+		} else if l.Address.Pipe == nil {
+			verr.add("listener `%s` has no address", l.Name)
+		}
+
+		if len(l.FilterChains) == 0 {
+			verr.add("listener `%s` has no filter chain", l.Name)
+		}
+		for _, fc := range l.FilterChains {
+			b.checkTransportSocket(verr, fc.TransportSocket, "listener `"+l.Name+"`")
+			for _, f := range fc.Filters {
+				switch config := f.TypedConfig.(type) {
+				case HTTPConnectionManager:
+					b.checkHTTPConnectionManager(verr, clusters, caches, config, l.Name)
+				case TCPProxy:
+					checkClusterRef(verr, clusters, config.Cluster, "listener `"+l.Name+"`")
+				}
+			}
+		}
+	}
+
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func (b *Bootstrap) checkHTTPConnectionManager(verr *ValidationError, clusters map[string]struct{}, caches map[string]DNSCacheConfig, hcm HTTPConnectionManager, listener string) {
+	for _, vh := range hcm.RouteConfig.VirtualHosts {
+		for _, r := range vh.Routes {
+			if r.Route != nil {
+				checkClusterRef(verr, clusters, r.Route.Cluster, fmt.Sprintf("route `%s` of listener `%s`", r.Match.Prefix+r.Match.Path, listener))
+			}
+		}
+	}
+
+	if len(hcm.HTTPFilters) == 0 || hcm.HTTPFilters[len(hcm.HTTPFilters)-1].Name != filterRouter {
+		verr.add("the last http filter of listener `%s` must be the router", listener)
+	}
+	for _, f := range hcm.HTTPFilters {
+		if rbac, ok := f.TypedConfig.(RBAC); ok && matchesPaths(rbac) && !(hcm.NormalizePath && hcm.MergeSlashes) {
+			verr.add("the RBAC filter of listener `%s` matches paths that are not normalized", listener)
+		}
+		if dfp, ok := f.TypedConfig.(DynamicForwardProxyFilter); ok {
+			if cache, ok := caches[dfp.DNSCacheConfig.Name]; !ok {
+				verr.add("dns cache `%s` of listener `%s` is not used by any dynamic forward proxy cluster", dfp.DNSCacheConfig.Name, listener)
+			} else if cache != dfp.DNSCacheConfig {
+				verr.add("dns cache `%s` of listener `%s` differs from the one of the dynamic forward proxy cluster", dfp.DNSCacheConfig.Name, listener)
+			}
+		}
+	}
+}
+
+func matchesPaths(rbac RBAC) bool {
+	if rbac.Rules == nil {
+		return false
+	}
+	for _, policy := range rbac.Rules.Policies {
+		for _, permission := range policy.Permissions {
+			if permission.URLPath != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *Bootstrap) checkTransportSocket(verr *ValidationError, ts *TransportSocket, owner string) {
+	if ts == nil {
+		return
+	}
+
+	var common CommonTLSContext
+	switch tls := ts.TypedConfig.(type) {
+	case UpstreamTLSContext:
+		common = tls.CommonTLSContext
+	case DownstreamTLSContext:
+		common = tls.CommonTLSContext
+		if len(common.TLSCertificateSDSSecretConfigs) == 0 {
+			verr.add("%s terminates TLS without a certificate", owner)
+		}
+	default:
+		return
+	}
+
+	for _, sds := range common.TLSCertificateSDSSecretConfigs {
+		b.checkSDSSecret(verr, sds, owner)
+	}
+	if common.ValidationContextSDSSecretConfig != nil {
+		b.checkSDSSecret(verr, *common.ValidationContextSDSSecretConfig, owner)
+	}
+	if common.CombinedValidationContext != nil {
+		b.checkSDSSecret(verr, common.CombinedValidationContext.ValidationContextSDSSecretConfig, owner)
+	}
+}
+
+// checkSDSSecret checks the secret name and the SDS clusters. The SDS clusters are
+// checked against every cluster of the bootstrap, as static clusters may refer to
+// clusters declared after them.
+func (b *Bootstrap) checkSDSSecret(verr *ValidationError, sds SDSSecretConfig, owner string) {
+	if sds.Name == "" {
+		verr.add("SDS secret of %s has no name", owner)
+	}
+	for _, g := range sds.SDSConfig.APIConfigSource.GRPCServices {
+		if b.Cluster(g.EnvoyGRPC.ClusterName) == nil {
+			verr.add("SDS secret `%s` of %s refers to unknown cluster `%s`", sds.Name, owner, g.EnvoyGRPC.ClusterName)
+		}
+	}
+}
+
+func checkClusterRef(verr *ValidationError, clusters map[string]struct{}, name, owner string) {
+	if _, ok := clusters[name]; !ok {
+		verr.add("%s refers to unknown cluster `%s`", owner, name)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/finalize"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+func main() {
+	logger := libbuildpack.NewLogger(os.Stdout)
+
+	buildpackDir, err := libbuildpack.GetBuildpackDir()
+	if err != nil {
+		logger.Error("Unable to determine buildpack directory: %s", err.Error())
+		os.Exit(9)
+	}
+
+	manifest, err := libbuildpack.NewManifest(buildpackDir, logger, time.Now())
+	if err != nil {
+		logger.Error("Unable to load buildpack manifest: %s", err.Error())
+		os.Exit(10)
+	}
+
+	stager := libbuildpack.NewStager(os.Args[1:], logger, manifest)
+
+	if err := stager.CheckBuildpackValid(); err != nil {
+		os.Exit(11)
+	}
+
+	if err = stager.SetStagingEnvironment(); err != nil {
+		logger.Error("Unable to setup environment variables: %s", err.Error())
+		os.Exit(13)
+	}
+
+	finalizer := finalize.New(stager, manifest, logger)
+
+	if err := finalizer.Run(); err != nil {
+		os.Exit(12)
+	}
+
+	if err := stager.SetLaunchEnvironment(); err != nil {
+		logger.Error("Unable to setup launch environment: %s", err.Error())
+		os.Exit(13)
+	}
+
+	stager.StagingComplete()
+}
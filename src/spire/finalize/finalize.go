@@ -0,0 +1,132 @@
+package finalize
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	spiffeEndpointSocket = "unix:///tmp/spire-agent/public/api.sock"
+	releaseStepFile      = "spire-agent-buildpack-release-step.yml"
+)
+
+type Stager interface {
+	BuildDir() string
+	DepDir() string
+	DepsIdx() string
+	WriteProfileD(string, string) error
+}
+
+type Manifest interface {
+	RootDir() string
+}
+
+type Finalizer struct {
+	Stager   Stager
+	Manifest Manifest
+	Log      *libbuildpack.Logger
+	Config   supply.Config
+}
+
+func New(stager Stager, manifest Manifest, logger *libbuildpack.Logger) *Finalizer {
+	return &Finalizer{
+		Stager:   stager,
+		Manifest: manifest,
+		Log:      logger,
+	}
+}
+
+func (f *Finalizer) Run() error {
+	f.Log.BeginStep("Finalizing spire")
+
+	if err := f.Setup(); err != nil {
+		f.Log.Error("Could not setup; %s", err.Error())
+		return err
+	}
+
+	if err := f.CheckSupplyOutput(); err != nil {
+		f.Log.Error("Spire was not supplied; %s", err.Error())
+		return err
+	}
+
+	if err := f.WriteProfileD(); err != nil {
+		f.Log.Error("Unable to write profile.d script; %s", err.Error())
+		return err
+	}
+
+	if err := f.WriteReleaseYml(); err != nil {
+		f.Log.Error("Unable to write release yml; %s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (f *Finalizer) Setup() error {
+	configPath := filepath.Join(f.Stager.BuildDir(), "buildpack.yml")
+	if exists, err := libbuildpack.FileExists(configPath); err != nil {
+		return err
+	} else if exists {
+		if err := libbuildpack.NewYAML().Load(configPath, &f.Config); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckSupplyOutput makes sure the supply phase ran for this buildpack, the finalize phase
+// only adds the start command and the runtime environment on top of its output.
+func (f *Finalizer) CheckSupplyOutput() error {
+	for _, file := range []string{"spire-agent.conf", "launch.yml", filepath.Join("bin", "spire-agent")} {
+		path := filepath.Join(f.Stager.DepDir(), file)
+		if exists, err := libbuildpack.FileExists(path); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("can't find `%s`", path)
+		}
+	}
+
+	return nil
+}
+
+func (f *Finalizer) WriteProfileD() error {
+	script := fmt.Sprintf("export SPIFFE_ENDPOINT_SOCKET=%s\nexport PATH=\"$PATH:$DEPS_DIR/%s/bin\"\n",
+		spiffeEndpointSocket, f.Stager.DepsIdx())
+
+	return f.Stager.WriteProfileD("spire.sh", script)
+}
+
+// WriteReleaseYml writes the default process types picked up by bin/release. The web
+// command is taken from the `start_command` in buildpack.yml or from the app's Procfile.
+func (f *Finalizer) WriteReleaseYml() error {
+	processTypes := map[string]string{}
+
+	command := strings.TrimSpace(f.Config.StartCommand)
+	if command == "" {
+		procfile, err := supply.ReadProcfile(f.Stager.BuildDir())
+		if err != nil {
+			return err
+		}
+		command = procfile["web"]
+	}
+
+	if command != "" {
+		processTypes["web"] = command
+	} else {
+		f.Log.Warning("No start command found in buildpack.yml or Procfile; the app must be pushed with a start command")
+	}
+
+	releasePath := filepath.Join(f.Stager.BuildDir(), "tmp", releaseStepFile)
+	if err := os.MkdirAll(filepath.Dir(releasePath), 0755); err != nil {
+		return err
+	}
+
+	return libbuildpack.NewYAML().Write(releasePath, map[string]map[string]string{
+		"default_process_types": processTypes,
+	})
+}
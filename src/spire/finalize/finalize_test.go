@@ -0,0 +1,100 @@
+package finalize
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakeManifest struct {
+	supply.Manifest
+}
+
+// RootDir is the root of the buildpack, which holds the launch templates.
+func (fakeManifest) RootDir() string { return filepath.Join("..", "..", "..") }
+
+func TestRun(t *testing.T) {
+	buildDir, cacheDir, depsDir := t.TempDir(), t.TempDir(), t.TempDir()
+	logger := libbuildpack.NewLogger(io.Discard)
+	stager := libbuildpack.NewStager([]string{buildDir, cacheDir, depsDir, "0"}, logger, nil)
+
+	if err := os.MkdirAll(filepath.Join(stager.DepDir(), "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"spire-agent.conf", filepath.Join("bin", "spire-agent")} {
+		if err := os.WriteFile(filepath.Join(stager.DepDir(), file), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("web: ./server\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := supply.New(stager, fakeManifest{}, nil, logger, nil)
+	s.Settings = supply.Settings{SVIDStore: true}
+	if err := s.CreateLaunchForSidecars(&supply.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := New(stager, nil, logger)
+	if err := f.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	var launch struct {
+		Processes []struct {
+			Type      string `yaml:"type"`
+			Platforms struct {
+				CloudFoundry struct {
+					SidecarFor []string `yaml:"sidecar_for"`
+				} `yaml:"cloudfoundry"`
+			} `yaml:"platforms"`
+		} `yaml:"processes"`
+	}
+	if err := libbuildpack.NewYAML().Load(filepath.Join(stager.DepDir(), "launch.yml"), &launch); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, p := range launch.Processes {
+		types = append(types, p.Type)
+		if sidecarFor := p.Platforms.CloudFoundry.SidecarFor; !reflect.DeepEqual(sidecarFor, []string{"web"}) {
+			t.Errorf("sidecar %s runs next to %v, want [web]", p.Type, sidecarFor)
+		}
+	}
+	if want := []string{"spire_agent", "svid-file-script"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got sidecars %v, want %v", types, want)
+	}
+
+	script, err := os.ReadFile(filepath.Join(stager.DepDir(), "profile.d", "spire.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"export SPIFFE_ENDPOINT_SOCKET=unix:///tmp/spire-agent/public/api.sock", `export PATH="$PATH:$DEPS_DIR/0/bin"`} {
+		if !strings.Contains(string(script), want) {
+			t.Errorf("profile.d script doesn't contain %s:\n%s", want, script)
+		}
+	}
+
+	var release map[string]map[string]string
+	if err := libbuildpack.NewYAML().Load(filepath.Join(buildDir, "tmp", releaseStepFile), &release); err != nil {
+		t.Fatal(err)
+	}
+	if web := release["default_process_types"]["web"]; web != "./server" {
+		t.Errorf("got web process `%s`, want the one of the Procfile", web)
+	}
+}
+
+func TestRunWithoutSupply(t *testing.T) {
+	buildDir, cacheDir, depsDir := t.TempDir(), t.TempDir(), t.TempDir()
+	logger := libbuildpack.NewLogger(io.Discard)
+	stager := libbuildpack.NewStager([]string{buildDir, cacheDir, depsDir, "0"}, logger, nil)
+
+	if err := New(stager, nil, logger).Run(); err == nil || !strings.Contains(err.Error(), "spire-agent.conf") {
+		t.Errorf("expected the missing supply output to be reported, got %v", err)
+	}
+}
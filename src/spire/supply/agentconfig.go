@@ -0,0 +1,150 @@
+package supply
+
+import (
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply/hcl"
+)
+
+// AgentConfig is the typed model of spire-agent.conf.
+type AgentConfig struct {
+	Agent     AgentSettings
+	Plugins   []PluginConfig
+	Telemetry TelemetryConfig
+}
+
+type AgentSettings struct {
+	ServerAddress           string
+	ServerPort              int
+	LogLevel                string
+	TrustDomain             string
+	DataDir                 string
+	JoinToken               string
+	TrustBundlePath         string
+	TrustBundleURL          string
+	TrustBundleFormat       string
+	WorkloadX509SVIDKeyType string
+}
+
+type TelemetryConfig struct {
+	PrometheusHost     string
+	PrometheusPort     int
+	DogStatsdAddresses []string
+	StatsdAddresses    []string
+}
+
+func (t TelemetryConfig) enabled() bool {
+	return t.PrometheusPort != 0 || len(t.DogStatsdAddresses) > 0 || len(t.StatsdAddresses) > 0
+}
+
+// HCL renders the configuration in the format read by the spire-agent.
+func (c AgentConfig) HCL() []byte {
+	w := &hcl.Writer{}
+
+	w.Block("agent", nil, func(w *hcl.Writer) {
+		a := c.Agent
+		w.Attr("server_address", a.ServerAddress)
+		w.Attr("server_port", a.ServerPort)
+		w.Attr("log_level", a.LogLevel)
+		w.Attr("trust_domain", a.TrustDomain)
+		w.Attr("data_dir", a.DataDir)
+		if a.JoinToken != "" {
+			w.Attr("join_token", a.JoinToken)
+		}
+		if a.TrustBundleURL != "" {
+			w.Attr("trust_bundle_url", a.TrustBundleURL)
+			w.Attr("trust_bundle_format", a.TrustBundleFormat)
+		} else {
+			w.Attr("trust_bundle_path", a.TrustBundlePath)
+		}
+		w.Attr("workload_x509_svid_key_type", a.WorkloadX509SVIDKeyType)
+	})
+
+	w.Blank()
+	w.Block("plugins", nil, func(w *hcl.Writer) {
+		for i, p := range c.Plugins {
+			if i > 0 {
+				w.Blank()
+			}
+			w.Block(p.Type, []string{p.Name}, func(w *hcl.Writer) {
+				if p.PluginCmd != "" {
+					w.Attr("plugin_cmd", p.PluginCmd)
+				}
+				if p.PluginChecksum != "" {
+					w.Attr("plugin_checksum", p.PluginChecksum)
+				}
+				w.Block("plugin_data", nil, func(w *hcl.Writer) {
+					w.Attrs(p.PluginData)
+				})
+			})
+		}
+	})
+
+	if c.Telemetry.enabled() {
+		w.Blank()
+		w.Block("telemetry", nil, func(w *hcl.Writer) {
+			t := c.Telemetry
+			if t.PrometheusPort != 0 {
+				w.Block("Prometheus", nil, func(w *hcl.Writer) {
+					w.Attr("host", t.PrometheusHost)
+					w.Attr("port", t.PrometheusPort)
+				})
+			}
+			if len(t.DogStatsdAddresses) > 0 {
+				w.Attr("DogStatsd", addressList(t.DogStatsdAddresses))
+			}
+			if len(t.StatsdAddresses) > 0 {
+				w.Attr("Statsd", addressList(t.StatsdAddresses))
+			}
+		})
+	}
+
+	return w.Bytes()
+}
+
+func addressList(addresses []string) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(addresses))
+	for _, address := range addresses {
+		list = append(list, map[string]interface{}{"address": address})
+	}
+	return list
+}
+
+// AgentConfig builds the agent configuration out of the settings. The trust bundle
+// path is only used when no trust bundle URL is set.
+func (s *Supplier) AgentConfig(trustBundlePath string) (AgentConfig, error) {
+	_, dataDir, err := s.DataDir()
+	if err != nil {
+		return AgentConfig{}, err
+	}
+
+	plugins, err := s.AgentPlugins()
+	if err != nil {
+		return AgentConfig{}, err
+	}
+
+	joinToken := ""
+	if s.Settings.NodeAttestor == nodeAttestorJoinToken {
+		joinToken = s.Settings.JoinToken
+	}
+
+	return AgentConfig{
+		Agent: AgentSettings{
+			ServerAddress:           s.Settings.ServerAddress,
+			ServerPort:              s.Settings.ServerPort,
+			LogLevel:                s.Settings.LogLevel,
+			TrustDomain:             s.Settings.TrustDomain,
+			DataDir:                 dataDir,
+			JoinToken:               joinToken,
+			TrustBundlePath:         trustBundlePath,
+			TrustBundleURL:          s.Settings.TrustBundleURL,
+			TrustBundleFormat:       s.Settings.TrustBundleFormat,
+			WorkloadX509SVIDKeyType: s.Settings.SvidKeyType,
+		},
+		Plugins: plugins,
+		Telemetry: TelemetryConfig{
+			PrometheusHost:     s.Settings.AgentPrometheusHost,
+			PrometheusPort:     s.Settings.AgentPrometheusPort,
+			DogStatsdAddresses: s.Settings.AgentDogStatsdAddresses,
+			StatsdAddresses:    s.Settings.AgentStatsdAddresses,
+		},
+	}, nil
+}
@@ -0,0 +1,148 @@
+package supply
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func baseAgentConfig() AgentConfig {
+	return AgentConfig{
+		Agent: AgentSettings{
+			ServerAddress:           "spire.example.org",
+			ServerPort:              8081,
+			LogLevel:                "INFO",
+			TrustDomain:             "example.org",
+			DataDir:                 "/home/vcap/deps/0/spire-agent-data",
+			TrustBundlePath:         "/home/vcap/deps/0/certificates/trust-bundle.crt",
+			WorkloadX509SVIDKeyType: "ec-p256",
+		},
+		Plugins: []PluginConfig{
+			{Type: "KeyManager", Name: "memory"},
+			{
+				Type:      "NodeAttestor",
+				Name:      "cf_iic",
+				PluginCmd: "/home/vcap/deps/0/bin/cf_iic",
+				PluginData: map[string]interface{}{
+					"private_key_path": "/etc/cf-instance-credentials/instance.key",
+					"certificate_path": "/etc/cf-instance-credentials/instance.crt",
+				},
+			},
+			{Type: "WorkloadAttestor", Name: "unix"},
+		},
+	}
+}
+
+func TestAgentConfigHCL(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *AgentConfig)
+	}{
+		{
+			name:   "minimal",
+			modify: func(c *AgentConfig) {},
+		},
+		{
+			name: "join_token",
+			modify: func(c *AgentConfig) {
+				c.Agent.JoinToken = "0f2a8e1c-7d3b-4e6a-8f9c-1b2d3e4f5a6b"
+				c.Plugins[1] = PluginConfig{Type: "NodeAttestor", Name: "join_token"}
+			},
+		},
+		{
+			name: "trust_bundle_url",
+			modify: func(c *AgentConfig) {
+				c.Agent.TrustBundlePath = ""
+				c.Agent.TrustBundleURL = "https://spire.example.org/bundle?format=spiffe&td=example.org"
+				c.Agent.TrustBundleFormat = "spiffe"
+			},
+		},
+		{
+			name: "disk_key_manager_and_plugins",
+			modify: func(c *AgentConfig) {
+				c.Plugins[0] = PluginConfig{
+					Type:       "KeyManager",
+					Name:       "disk",
+					PluginData: map[string]interface{}{"directory": "/home/vcap/deps/0/spire-agent-data"},
+				}
+				c.Plugins = append(c.Plugins,
+					PluginConfig{
+						Type:       "SVIDStore",
+						Name:       "cf",
+						PluginCmd:  "/home/vcap/deps/0/bin/svidstore_file",
+						PluginData: map[string]interface{}{"write_path": "/tmp/spire-agent"},
+					},
+					PluginConfig{
+						Type:           "WorkloadAttestor",
+						Name:           "custom",
+						PluginCmd:      "/home/vcap/app/plugins/custom",
+						PluginChecksum: "7c2b7f60030eede8c6587bb72d0ddf90ae0069620c6042add5fd17ad35be367a",
+						PluginData: map[string]interface{}{
+							"enabled": true,
+							"limit":   1024,
+							"ratio":   0.5,
+							"labels":  []interface{}{"a", "b"},
+							"nested":  map[interface{}]interface{}{"key": "value"},
+						},
+					},
+				)
+				c.Plugins[2].PluginData = map[string]interface{}{
+					"discover_workload_path": true,
+					"workload_size_limit":    0,
+				}
+			},
+		},
+		{
+			name: "telemetry",
+			modify: func(c *AgentConfig) {
+				c.Telemetry = TelemetryConfig{
+					PrometheusHost:     "localhost",
+					PrometheusPort:     9988,
+					DogStatsdAddresses: []string{"localhost:8125"},
+					StatsdAddresses:    []string{"localhost:8126", "statsd.example.org:8125"},
+				}
+			},
+		},
+		{
+			name: "escaping",
+			modify: func(c *AgentConfig) {
+				c.Agent.ServerAddress = `spire.example.org" insecure_bootstrap = true "`
+				c.Agent.LogLevel = "INFO & <DEBUG>"
+				c.Plugins[2].PluginData = map[string]interface{}{
+					"path":        `C:\agent\${HOME}`,
+					"multi-line":  "a\nb\tc",
+					"with space":  "x",
+					"unicode":     "zürich",
+					`quote"key`:   "y",
+					"placeholder": "${PORT}",
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := baseAgentConfig()
+			tt.modify(&config)
+			actual := config.HCL()
+
+			golden := filepath.Join("testdata", "agentconf", tt.name+".hcl")
+			if *update {
+				if err := os.WriteFile(golden, actual, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != string(expected) {
+				t.Errorf("HCL doesn't match %s:\n--- actual\n%s\n--- expected\n%s", golden, actual, expected)
+			}
+		})
+	}
+}
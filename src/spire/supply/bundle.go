@@ -0,0 +1,205 @@
+package supply
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	trustBundleFile = "trust-bundle.crt"
+
+	trustBundleFormatPEM    = "pem"
+	trustBundleFormatSPIFFE = "spiffe"
+
+	trustBundleFetchTimeout = 10 * time.Second
+)
+
+// TrustBundle returns the PEM encoded trust bundle of the agent and where it came from.
+// It is only used when no trust bundle URL is set; the URL always takes precedence over
+// any local bundle, see UsesTrustBundleURL. An inline bundle, from the service binding
+// or SPIRE_TRUST_BUNDLE, wins over the app file referenced in buildpack.yml; without
+// either the bundle shipped with the buildpack is used, see WriteTrustBundle.
+func (s *Supplier) TrustBundle() ([]byte, string, error) {
+	if s.Settings.TrustBundle != "" {
+		return []byte(s.Settings.TrustBundle), "inline bundle", nil
+	}
+
+	if s.Settings.TrustBundleFile != "" {
+		path := filepath.Join(s.Stager.BuildDir(), s.Settings.TrustBundleFile)
+		if rel, err := filepath.Rel(s.Stager.BuildDir(), path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, "", fmt.Errorf("trust bundle file `%s` is outside of the app directory", s.Settings.TrustBundleFile)
+		}
+		bundle, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		return bundle, path, nil
+	}
+
+	path := s.shippedTrustBundlePath()
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return bundle, path, nil
+}
+
+// shippedTrustBundlePath is the bundle shipped with the buildpack; it is read from the
+// buildpack directory and only ends up in the droplet when it is used.
+func (s *Supplier) shippedTrustBundlePath() string {
+	return filepath.Join(s.Manifest.RootDir(), "certificates", "bundle.crt")
+}
+
+// UsesTrustBundleURL reports whether the agent bootstraps its trust bundle from a bundle
+// endpoint instead of a local file.
+func (s *Supplier) UsesTrustBundleURL() bool {
+	return s.Settings.TrustBundleURL != ""
+}
+
+// WriteTrustBundle writes the trust bundle next to the agent configuration and returns
+// its path at runtime.
+func (s *Supplier) WriteTrustBundle() (string, error) {
+	bundle, source, err := s.TrustBundle()
+	if err != nil {
+		return "", err
+	}
+	if source == s.shippedTrustBundlePath() {
+		s.Log.Warning("No trust bundle is configured; using the bundle shipped with the buildpack. " +
+			"Set SPIRE_TRUST_BUNDLE, SPIRE_TRUST_BUNDLE_URL or spire-agent.trust_bundle_file in buildpack.yml")
+	}
+
+	path := filepath.Join(s.Stager.DepDir(), "certificates", trustBundleFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, bundle, 0644); err != nil {
+		return "", err
+	}
+
+	s.Log.Info("Trust bundle from %s written to %s", source, path)
+
+	return filepath.Join("/home/vcap/deps", s.Stager.DepsIdx(), "certificates", trustBundleFile), nil
+}
+
+// ParseTrustBundle parses the PEM encoded CA certificates of a trust bundle.
+func ParseTrustBundle(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	rest := bundle
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block of type `%s`", block.Type)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if !cert.IsCA {
+			return nil, fmt.Errorf("certificate `%s` is not a CA certificate", cert.Subject)
+		}
+		certs = append(certs, cert)
+	}
+
+	if strings.TrimSpace(string(rest)) != "" {
+		return nil, fmt.Errorf("trailing data which is not PEM encoded")
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
+// ValidateTrustBundleURL checks the bundle endpoint settings the same way the agent does.
+func ValidateTrustBundleURL(bundleURL, format string) error {
+	u, err := url.Parse(bundleURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("must be an https URL")
+	}
+	if format != trustBundleFormatPEM && format != trustBundleFormatSPIFFE {
+		return fmt.Errorf("unsupported trust bundle format `%s`; use `%s` or `%s`", format, trustBundleFormatPEM, trustBundleFormatSPIFFE)
+	}
+	return nil
+}
+
+// FetchTrustBundle downloads the bundle from the endpoint and checks that it contains
+// at least one CA certificate in the given format.
+func FetchTrustBundle(bundleURL, format string) ([]*x509.Certificate, error) {
+	client := &http.Client{Timeout: trustBundleFetchTimeout}
+	resp, err := client.Get(bundleURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status `%s`", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == trustBundleFormatSPIFFE {
+		return ParseSpiffeBundle(body)
+	}
+	return ParseTrustBundle(body)
+}
+
+// ParseSpiffeBundle parses the X.509 authorities of a bundle in the SPIFFE bundle format,
+// a JWK set whose `x509-svid` keys carry the CA certificate in `x5c`.
+func ParseSpiffeBundle(bundle []byte) ([]*x509.Certificate, error) {
+	var jwks struct {
+		Keys []struct {
+			Use string   `json:"use"`
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(bundle, &jwks); err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for _, key := range jwks.Keys {
+		if key.Use != "x509-svid" {
+			continue
+		}
+		if len(key.X5c) != 1 {
+			return nil, fmt.Errorf("x509-svid key must have exactly one certificate, got %d", len(key.X5c))
+		}
+
+		der, err := base64.StdEncoding.DecodeString(key.X5c[0])
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no x509-svid authorities found")
+	}
+	return certs, nil
+}
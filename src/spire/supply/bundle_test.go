@@ -0,0 +1,245 @@
+package supply
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/cloudfoundry/libbuildpack"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCertificate(t *testing.T, cn string, ca bool) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func testPEM(t *testing.T, cn string, ca bool) []byte {
+	t.Helper()
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testCertificate(t, cn, ca)})
+}
+
+func TestTrustBundle(t *testing.T) {
+	buildDir, rootDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(buildDir, "bundle.crt"), []byte("app bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "..bundle.crt"), []byte("dotted bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootDir, "certificates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "certificates", "bundle.crt"), []byte("shipped bundle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		inline   string
+		file     string
+		expected string
+		err      string
+	}{
+		{name: "inline wins over the file", inline: "inline bundle", file: "bundle.crt", expected: "inline bundle"},
+		{name: "app file", file: "bundle.crt", expected: "app bundle"},
+		{name: "app file starting with ..", file: "..bundle.crt", expected: "dotted bundle"},
+		{name: "shipped bundle", expected: "shipped bundle"},
+		{name: "file outside of the app", file: "../bundle.crt", err: "outside of the app directory"},
+		{name: "missing file", file: "missing.crt", err: "no such file"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Supplier{
+				Stager:   fakeStager{buildDir: buildDir},
+				Manifest: fakeManifest{rootDir: rootDir},
+				Settings: Settings{TrustBundle: test.inline, TrustBundleFile: test.file},
+			}
+
+			bundle, _, err := s.TrustBundle()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bundle) != test.expected {
+				t.Errorf("got bundle %q, want %q", bundle, test.expected)
+			}
+		})
+	}
+}
+
+func TestWriteTrustBundleWarnsAboutShippedBundle(t *testing.T) {
+	rootDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootDir, "certificates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "certificates", "bundle.crt"), testPEM(t, "ca", true), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inline := range []string{"", string(testPEM(t, "inline ca", true))} {
+		var out bytes.Buffer
+		s := &Supplier{
+			Stager:   fakeStager{buildDir: t.TempDir(), depDir: t.TempDir()},
+			Manifest: fakeManifest{rootDir: rootDir},
+			Log:      libbuildpack.NewLogger(&out),
+			Settings: Settings{TrustBundle: inline},
+		}
+		if _, err := s.WriteTrustBundle(); err != nil {
+			t.Fatal(err)
+		}
+		if warned := strings.Contains(out.String(), "shipped with the buildpack"); warned != (inline == "") {
+			t.Errorf("warning about the shipped bundle: %t, want %t; log:\n%s", warned, inline == "", out.String())
+		}
+	}
+}
+
+func TestParseTrustBundle(t *testing.T) {
+	ca, other := testPEM(t, "ca", true), testPEM(t, "other ca", true)
+	key := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("key")})
+
+	tests := []struct {
+		name   string
+		bundle []byte
+		certs  int
+		err    string
+	}{
+		{name: "one CA", bundle: ca, certs: 1},
+		{name: "two CAs", bundle: append(append([]byte{}, ca...), other...), certs: 2},
+		{name: "empty", bundle: []byte("\n"), err: "no certificates found"},
+		{name: "not PEM", bundle: []byte("not a bundle"), err: "trailing data"},
+		{name: "trailing data", bundle: append(append([]byte{}, ca...), "garbage"...), err: "trailing data"},
+		{name: "private key", bundle: key, err: "unexpected PEM block of type `EC PRIVATE KEY`"},
+		{name: "leaf certificate", bundle: testPEM(t, "leaf", false), err: "is not a CA certificate"},
+		{name: "invalid certificate", bundle: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("der")}), err: "x509"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certs, err := ParseTrustBundle(test.bundle)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(certs) != test.certs {
+				t.Errorf("got %d certificates, want %d", len(certs), test.certs)
+			}
+		})
+	}
+}
+
+func TestParseSpiffeBundle(t *testing.T) {
+	ca := base64.StdEncoding.EncodeToString(testCertificate(t, "ca", true))
+
+	tests := []struct {
+		name   string
+		bundle string
+		certs  int
+		err    string
+	}{
+		{
+			name:   "x509 authority",
+			bundle: `{"keys": [{"use": "x509-svid", "kty": "EC", "x5c": ["` + ca + `"]}]}`,
+			certs:  1,
+		},
+		{
+			name:   "jwt authorities are skipped",
+			bundle: `{"keys": [{"use": "jwt-svid", "kty": "EC", "kid": "k1"}, {"use": "x509-svid", "x5c": ["` + ca + `"]}]}`,
+			certs:  1,
+		},
+		{name: "no x509 authorities", bundle: `{"keys": [{"use": "jwt-svid", "kid": "k1"}]}`, err: "no x509-svid authorities found"},
+		{name: "several certificates", bundle: `{"keys": [{"use": "x509-svid", "x5c": ["` + ca + `", "` + ca + `"]}]}`, err: "exactly one certificate, got 2"},
+		{name: "no certificate", bundle: `{"keys": [{"use": "x509-svid"}]}`, err: "exactly one certificate, got 0"},
+		{name: "not base64", bundle: `{"keys": [{"use": "x509-svid", "x5c": ["%%%"]}]}`, err: "illegal base64"},
+		{name: "not a certificate", bundle: `{"keys": [{"use": "x509-svid", "x5c": ["ZGVy"]}]}`, err: "x509"},
+		{name: "PEM instead of JWKS", bundle: string(testPEM(t, "ca", true)), err: "invalid character"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			certs, err := ParseSpiffeBundle([]byte(test.bundle))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(certs) != test.certs {
+				t.Errorf("got %d certificates, want %d", len(certs), test.certs)
+			}
+		})
+	}
+}
+
+func TestValidateTrustBundleURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		format string
+		err    string
+	}{
+		{url: "https://spire.example.org/bundle", format: "pem"},
+		{url: "https://spire.example.org:8443", format: "spiffe"},
+		{url: "http://spire.example.org/bundle", format: "pem", err: "must be an https URL"},
+		{url: "https:///bundle", format: "pem", err: "must be an https URL"},
+		{url: "spire.example.org/bundle", format: "pem", err: "must be an https URL"},
+		{url: "https://spire.example.org/%zz", format: "pem", err: "invalid URL escape"},
+		{url: "https://spire.example.org/bundle", format: "jwks", err: "unsupported trust bundle format `jwks`"},
+		{url: "https://spire.example.org/bundle", format: "", err: "unsupported trust bundle format"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url+" "+test.format, func(t *testing.T) {
+			err := ValidateTrustBundleURL(test.url, test.format)
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply"
 	"os"
 	"time"
@@ -49,6 +50,10 @@ func main() {
 	supplier := supply.New(stager, manifest, installer, logger, &libbuildpack.Command{})
 
 	if err := supplier.Run(); err != nil {
+		var verr *supply.ValidationError
+		if errors.As(err, &verr) {
+			os.Exit(20)
+		}
 		os.Exit(14)
 	}
 
@@ -0,0 +1,48 @@
+package supply
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dataDirRootDeps = "deps"
+	dataDirRootApp  = "app"
+
+	keyManagerMemory = "memory"
+	keyManagerDisk   = "disk"
+)
+
+// DataDir returns the agent data directory at staging time and at runtime. It lives on
+// the instance's ephemeral disk, either in this buildpack's deps dir or in the app dir,
+// so the agent keeps its SVID and keys across sidecar restarts.
+func (s *Supplier) DataDir() (string, string, error) {
+	dir := filepath.Clean(s.Settings.DataDir)
+	if filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("data dir `%s` must be a relative path inside the %s dir", s.Settings.DataDir, s.Settings.DataDirRoot)
+	}
+
+	switch s.Settings.DataDirRoot {
+	case dataDirRootDeps:
+		return filepath.Join(s.Stager.DepDir(), dir), filepath.Join("/home/vcap/deps", s.Stager.DepsIdx(), dir), nil
+	case dataDirRootApp:
+		return filepath.Join(s.Stager.BuildDir(), dir), filepath.Join("/home/vcap/app", dir), nil
+	}
+	return "", "", fmt.Errorf("unsupported data dir root `%s`; use `%s` or `%s`", s.Settings.DataDirRoot, dataDirRootDeps, dataDirRootApp)
+}
+
+// SetupDataDir creates the agent data directory, readable only by the vcap user since
+// the disk KeyManager keeps the private keys in it.
+func (s *Supplier) SetupDataDir() error {
+	dir, _, err := s.DataDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(dir, 0700)
+}
@@ -0,0 +1,69 @@
+package supply
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDataDir(t *testing.T) {
+	stager := fakeStager{buildDir: "/tmp/app", depDir: "/tmp/deps/0"}
+
+	tests := []struct {
+		root    string
+		dir     string
+		staging string
+		runtime string
+		err     string
+	}{
+		{root: "deps", dir: "spire-agent-data", staging: "/tmp/deps/0/spire-agent-data", runtime: "/home/vcap/deps/0/spire-agent-data"},
+		{root: "app", dir: ".spire/data/", staging: "/tmp/app/.spire/data", runtime: "/home/vcap/app/.spire/data"},
+		{root: "deps", dir: "a/../data", staging: "/tmp/deps/0/data", runtime: "/home/vcap/deps/0/data"},
+		{root: "app", dir: "..data", staging: "/tmp/app/..data", runtime: "/home/vcap/app/..data"},
+		{root: "deps", dir: "/var/spire", err: "must be a relative path inside the deps dir"},
+		{root: "app", dir: "../data", err: "must be a relative path inside the app dir"},
+		{root: "app", dir: "data/../../..", err: "must be a relative path"},
+		{root: "deps", dir: ".", err: "must be a relative path"},
+		{root: "tmp", dir: "data", err: "unsupported data dir root `tmp`"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.root+" "+test.dir, func(t *testing.T) {
+			s := &Supplier{Stager: stager, Settings: Settings{DataDirRoot: test.root, DataDir: test.dir}}
+
+			staging, runtime, err := s.DataDir()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if staging != test.staging || runtime != test.runtime {
+				t.Errorf("got %s, %s, want %s, %s", staging, runtime, test.staging, test.runtime)
+			}
+		})
+	}
+}
+
+func TestSetupDataDir(t *testing.T) {
+	depDir := t.TempDir()
+	s := &Supplier{
+		Stager:   fakeStager{depDir: depDir},
+		Settings: Settings{DataDirRoot: "deps", DataDir: "spire-agent-data"},
+	}
+
+	if err := s.SetupDataDir(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(depDir, "spire-agent-data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("got permissions %o, want 700", perm)
+	}
+}
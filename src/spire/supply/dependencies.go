@@ -0,0 +1,161 @@
+package supply
+
+import (
+	"fmt"
+	"github.com/cloudfoundry/libbuildpack"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	spireAgentDependency    = "spire-agent"
+	cfIicDependency         = "cf_iic"
+	svidStoreFileDependency = "svidstore_file"
+	configUpdaterDependency = "config-updater"
+)
+
+// requiredDependencies returns the manifest dependencies the settings need.
+func (s *Supplier) requiredDependencies(creds *Credentials) []string {
+	deps := []string{spireAgentDependency}
+
+	if s.Settings.NodeAttestor == nodeAttestorCfIic {
+		deps = append(deps, cfIicDependency)
+	}
+
+	if s.Settings.SVIDStore {
+		deps = append(deps, svidStoreFileDependency)
+	}
+
+	if creds == nil {
+		deps = append(deps, configUpdaterDependency)
+	}
+
+	return deps
+}
+
+// ValidateDependencies checks that the buildpack's manifest provides the dependencies
+// the settings need, so that a missing one fails with the setting which requires it.
+func (s *Supplier) ValidateDependencies() []string {
+	hints := map[string]string{
+		cfIicDependency:         "select another node attestor with SPIRE_NODE_ATTESTOR",
+		svidStoreFileDependency: "unset SPIRE_CLOUDFOUNDRY_SVID_STORE",
+		configUpdaterDependency: "bind a spire service",
+	}
+
+	var problems []string
+	for _, name := range s.requiredDependencies(s.Credentials) {
+		if len(s.Manifest.AllDependencyVersions(name)) > 0 {
+			continue
+		}
+		problem := fmt.Sprintf("the buildpack's manifest.yml doesn't provide the %s dependency", name)
+		if hint, ok := hints[name]; ok {
+			problem += "; " + hint
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+func (s *Supplier) InstallDependencies(creds *Credentials) error {
+	for _, name := range s.requiredDependencies(creds) {
+		var dep libbuildpack.Dependency
+		var err error
+		if name == spireAgentDependency {
+			dep, err = s.SpireAgentDependency()
+		} else {
+			dep, err = s.Manifest.DefaultVersion(name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.InstallBinary(dep, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SpireAgentDependency resolves the spire-agent version requested in buildpack.yml.
+func (s *Supplier) SpireAgentDependency() (libbuildpack.Dependency, error) {
+	return ResolveSpireAgentVersion(s.Manifest, s.VersionLines, s.Config.SpireAgent.Version)
+}
+
+// ResolveSpireAgentVersion picks the spire-agent dependency for the requested version.
+// The requested version may be an exact version, a constraint such as `1.6.x` or a
+// named line from the manifest's version_lines; without one the default version is used.
+func ResolveSpireAgentVersion(manifest Manifest, versionLines map[string]string, requested string) (libbuildpack.Dependency, error) {
+	constraint := strings.TrimSpace(requested)
+	if constraint == "" {
+		return manifest.DefaultVersion(spireAgentDependency)
+	}
+
+	if line, ok := versionLines[constraint]; ok {
+		constraint = line
+	}
+
+	versions := manifest.AllDependencyVersions(spireAgentDependency)
+	version, err := libbuildpack.FindMatchingVersion(constraint, versions)
+	if err != nil {
+		return libbuildpack.Dependency{}, fmt.Errorf("no %s version matches `%s`; available versions: %s",
+			spireAgentDependency, requested, strings.Join(versions, ", "))
+	}
+
+	return libbuildpack.Dependency{Name: spireAgentDependency, Version: version}, nil
+}
+
+// LoadVersionLines reads the version_lines of the manifest in the buildpack root dir.
+func LoadVersionLines(rootDir string) (map[string]string, error) {
+	var m struct {
+		VersionLines map[string]string `yaml:"version_lines"`
+	}
+	if err := libbuildpack.NewYAML().Load(filepath.Join(rootDir, "manifest.yml"), &m); err != nil {
+		return nil, err
+	}
+	return m.VersionLines, nil
+}
+
+// InstallBinary installs the dependency into its own directory under the dep dir and
+// links the executable named binary into the dep dir's bin directory.
+func (s *Supplier) InstallBinary(dep libbuildpack.Dependency, binary string) error {
+	installDir := filepath.Join(s.Stager.DepDir(), "dependencies", dep.Name)
+	if err := s.Installer.InstallDependency(dep, installDir); err != nil {
+		return err
+	}
+
+	binPath, err := findFile(installDir, binary)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(binPath, 0755); err != nil {
+		return err
+	}
+
+	s.Log.Info("Installed %s %s to %s", dep.Name, dep.Version, binPath)
+
+	return s.Stager.AddBinDependencyLink(binPath, binary)
+}
+
+func findFile(dir, name string) (string, error) {
+	found := ""
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if found == "" && !info.IsDir() && info.Name() == name {
+			found = path
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if found == "" {
+		return "", fmt.Errorf("can't find `%s` in %s", name, dir)
+	}
+	return found, nil
+}
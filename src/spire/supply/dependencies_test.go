@@ -0,0 +1,52 @@
+package supply
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateDependencies(t *testing.T) {
+	manifest := fakeManifest{versions: map[string][]string{
+		spireAgentDependency:    {"1.6.3", "1.5.6"},
+		configUpdaterDependency: {"1.0.0"},
+	}}
+
+	tests := []struct {
+		name        string
+		settings    Settings
+		credentials *Credentials
+		problems    []string
+	}{
+		{
+			name:        "join_token",
+			settings:    Settings{NodeAttestor: nodeAttestorJoinToken},
+			credentials: &Credentials{},
+		},
+		{
+			name:     "config-updater",
+			settings: Settings{NodeAttestor: nodeAttestorJoinToken},
+		},
+		{
+			name:        "cf_iic and svid store",
+			settings:    Settings{NodeAttestor: nodeAttestorCfIic, SVIDStore: true},
+			credentials: &Credentials{},
+			problems:    []string{"cf_iic dependency; select another node attestor", "svidstore_file dependency; unset SPIRE_CLOUDFOUNDRY_SVID_STORE"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Supplier{Manifest: manifest, Credentials: test.credentials, Settings: test.settings}
+
+			problems := s.ValidateDependencies()
+			if len(problems) != len(test.problems) {
+				t.Fatalf("got problems %q, want %q", problems, test.problems)
+			}
+			for i, p := range test.problems {
+				if !strings.Contains(problems[i], p) {
+					t.Errorf("problem %q doesn't contain %q", problems[i], p)
+				}
+			}
+		})
+	}
+}
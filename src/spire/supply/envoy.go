@@ -0,0 +1,431 @@
+package supply
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/envoy"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ymlErrorLine    = regexp.MustCompile(`^line \d+: `)
+	ymlUnknownField = regexp.MustCompile(`field (\S+) not found in type \S+`)
+)
+
+const (
+	runtimeTrustDomain = "config-updater.invalid"
+
+	ymlEgressHosts  = "envoy.egress.hosts"
+	ymlTCPTunnels   = "envoy.tcp_tunnels"
+	ymlDestinations = "envoy.destinations"
+)
+
+// EgressHostConfig is a host of `envoy.egress.hosts` in buildpack.yml. The host maps
+// either to a policy as in SPIRE_ENVOY_EGRESS, such as `tls`, or to a mapping of the mode
+// and, for mtls, the spiffe_id or trust_domain expected from the upstream.
+type EgressHostConfig struct {
+	Mode        string `yaml:"mode"`
+	SpiffeID    string `yaml:"spiffe_id"`
+	TrustDomain string `yaml:"trust_domain"`
+}
+
+func (c EgressHostConfig) policy() (string, error) {
+	if c.SpiffeID != "" && c.TrustDomain != "" {
+		return "", fmt.Errorf("set either spiffe_id or trust_domain, not both")
+	}
+	expected := c.SpiffeID + c.TrustDomain
+	if expected == "" {
+		return c.Mode, nil
+	}
+	if c.Mode != envoy.EgressMTLS {
+		return "", fmt.Errorf("spiffe_id and trust_domain need the `%s` mode", envoy.EgressMTLS)
+	}
+	return c.Mode + ":" + expected, nil
+}
+
+// TCPTunnelConfig is an upstream of `envoy.tcp_tunnels` in buildpack.yml. The upstream
+// maps either to the local port, or to a mapping of the local_port and the spiffe_id or
+// trust_domain expected from the upstream.
+type TCPTunnelConfig struct {
+	LocalPort   int    `yaml:"local_port"`
+	SpiffeID    string `yaml:"spiffe_id"`
+	TrustDomain string `yaml:"trust_domain"`
+}
+
+func (c TCPTunnelConfig) tunnel() (string, error) {
+	if c.SpiffeID != "" && c.TrustDomain != "" {
+		return "", fmt.Errorf("set either spiffe_id or trust_domain, not both")
+	}
+	tunnel := strconv.Itoa(c.LocalPort)
+	if expected := c.SpiffeID + c.TrustDomain; expected != "" {
+		tunnel += ":" + expected
+	}
+	return tunnel, nil
+}
+
+// DestinationConfig is a host of `envoy.destinations` in buildpack.yml, a mapping of the
+// overrides of SPIRE_ENVOY_DESTINATIONS with retry_on as a list.
+type DestinationConfig struct {
+	RequestTimeout     string   `yaml:"request_timeout"`
+	RetryOn            []string `yaml:"retry_on"`
+	MaxRetries         int      `yaml:"max_retries"`
+	MaxConnections     int      `yaml:"max_connections"`
+	MaxPendingRequests int      `yaml:"max_pending_requests"`
+	MaxRequests        int      `yaml:"max_requests"`
+}
+
+func (c DestinationConfig) resiliency() (envoy.Resiliency, error) {
+	r := envoy.Resiliency{
+		RetryOn:            c.RetryOn,
+		MaxRetries:         c.MaxRetries,
+		MaxConnections:     c.MaxConnections,
+		MaxPendingRequests: c.MaxPendingRequests,
+		MaxRequests:        c.MaxRequests,
+	}
+	if c.RequestTimeout != "" {
+		var err error
+		if r.RequestTimeout, err = time.ParseDuration(c.RequestTimeout); err != nil {
+			return envoy.Resiliency{}, fmt.Errorf("value `%s` of `request_timeout` is invalid: %v", c.RequestTimeout, err)
+		}
+	}
+	return r, nil
+}
+
+// ymlEntry is an entry of a buildpack.yml mapping.
+type ymlEntry struct {
+	key   string
+	value interface{}
+}
+
+// ymlEntries returns the entries of the buildpack.yml mapping at path sorted by key.
+func ymlEntries(config map[string]interface{}, path string) ([]ymlEntry, error) {
+	value, ok := lookupYmlValue(config, path)
+	if !ok {
+		return nil, nil
+	}
+
+	var entries []ymlEntry
+	switch m := value.(type) {
+	case map[string]interface{}:
+		for k, v := range m {
+			entries = append(entries, ymlEntry{key: k, value: v})
+		}
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			entries = append(entries, ymlEntry{key: fmt.Sprint(k), value: v})
+		}
+	default:
+		return nil, fmt.Errorf("`%s` in buildpack.yml must be a mapping", path)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries, nil
+}
+
+// decodeYmlEntry decodes the value of a structured buildpack.yml entry into out. Unknown
+// keys and values of the wrong type fail instead of being ignored.
+func decodeYmlEntry(value interface{}, out interface{}) error {
+	if value == nil {
+		return fmt.Errorf("has no value")
+	}
+	if isYmlScalar(value) {
+		return fmt.Errorf("must be a mapping, not `%v`", value)
+	}
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	var terr *yaml.TypeError
+	if err := yaml.UnmarshalStrict(data, out); errors.As(err, &terr) {
+		// The line numbers are the ones of the re-encoded entry, not of buildpack.yml.
+		problems := make([]string, 0, len(terr.Errors))
+		for _, e := range terr.Errors {
+			e = ymlErrorLine.ReplaceAllString(e, "")
+			problems = append(problems, ymlUnknownField.ReplaceAllString(e, "unknown key `$1`"))
+		}
+		return errors.New(strings.Join(problems, "; "))
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// EnvoyOptions returns the options of the envoy proxy bootstrap. The invalid egress
+// policies, tcp tunnels and destinations are left out; EgressPolicies, TCPTunnels and
+// Destinations report them.
+//
+// With the config-updater the unset trust domain and SPIFFE ID of the proxy are stand-ins
+// under the `config-updater.invalid` trust domain, which the config-updater replaces with
+// the identity it receives at runtime.
+func (s *Supplier) EnvoyOptions() envoy.Options {
+	o := envoy.DefaultOptions()
+	o.SpiffeID = s.Settings.SpiffeID
+	o.TrustDomain = s.Settings.TrustDomain
+	if s.UsesConfigUpdater() {
+		if o.TrustDomain == "" {
+			o.TrustDomain = runtimeTrustDomain
+		}
+		if o.SpiffeID == "" {
+			o.SpiffeID = "spiffe://" + o.TrustDomain + "/runtime"
+		}
+	}
+	o.AppPort = s.Settings.EnvoyAppPort
+	o.Egress, _ = s.EgressPolicies()
+	o.DefaultEgress = s.Settings.EnvoyEgressDefault
+	o.TCPTunnels, _ = s.TCPTunnels()
+	o.TCPTunnelAddress = s.Settings.EnvoyTCPTunnelAddress
+	o.ListenerAddress = s.Settings.EnvoyListenerAddress
+	o.ListenerPort = s.Settings.EnvoyListenerPort
+	o.ConnectionLimit = s.Settings.EnvoyConnectionLimit
+	o.GlobalDownstreamMaxConnections = s.Settings.EnvoyMaxConnections
+	o.DNSLookupFamily = s.Settings.EnvoyDNSLookupFamily
+	o.IdleTimeout = s.Settings.EnvoyIdleTimeout
+	o.ConnectTimeout = s.Settings.EnvoyConnectTimeout
+	o.Resiliency = envoy.Resiliency{
+		RequestTimeout:     s.Settings.EnvoyRequestTimeout,
+		RetryOn:            s.Settings.EnvoyRetryOn,
+		MaxRetries:         s.Settings.EnvoyMaxRetries,
+		MaxConnections:     s.Settings.EnvoyCBMaxConnections,
+		MaxPendingRequests: s.Settings.EnvoyCBMaxPending,
+		MaxRequests:        s.Settings.EnvoyCBMaxRequests,
+	}
+	o.Destinations, _ = s.Destinations()
+	o.StatsdAddresses = s.Settings.EnvoyStatsdAddresses
+	o.DogStatsdAddresses = s.Settings.EnvoyDogStatsdAddresses
+
+	if s.Settings.EnvoyIngress {
+		o.Ingress = &envoy.IngressOptions{
+			Address:             s.Settings.EnvoyIngressAddress,
+			Port:                s.Settings.EnvoyIngressPort,
+			IdentityHeader:      s.Settings.EnvoyIngressIDHeader,
+			AllowedSpiffeIDs:    s.Settings.EnvoyIngressAllowedIDs,
+			AllowedPathPrefixes: s.Settings.EnvoyIngressAllowedPath,
+		}
+	}
+	if s.Settings.EnvoyAdmin {
+		o.Admin = &envoy.AdminOptions{
+			Address:           s.Settings.EnvoyAdminAddress,
+			Port:              s.Settings.EnvoyAdminPort,
+			PrometheusAddress: s.Settings.EnvoyPrometheusAddress,
+			PrometheusPort:    s.Settings.EnvoyPrometheusPort,
+		}
+	}
+	return o
+}
+
+// ValidateEnvoy checks the envoy options and the structure of the resulting bootstrap.
+func (s *Supplier) ValidateEnvoy() []string {
+	o := s.EnvoyOptions()
+	_, problems := s.EgressPolicies()
+	_, tunnelProblems := s.TCPTunnels()
+	_, destinationProblems := s.Destinations()
+	problems = append(problems, tunnelProblems...)
+	if problems = append(problems, destinationProblems...); len(problems) > 0 {
+		return problems
+	}
+	if s.Settings.EnvoyPrometheusPort != 0 && !s.Settings.EnvoyAdmin {
+		problems = append(problems, "the envoy prometheus endpoint requires the admin interface; set SPIRE_ENVOY_ADMIN")
+	}
+	if len(o.Egress) == 0 && o.DefaultEgress == envoy.EgressDeny {
+		s.Log.Warning("The envoy proxy has no egress policy; it denies every outbound request. " +
+			"Set policies with SPIRE_ENVOY_EGRESS or SPIRE_ENVOY_UPSTREAMS, or change SPIRE_ENVOY_EGRESS_DEFAULT")
+	}
+	if problems = append(problems, o.Validate()...); len(problems) > 0 {
+		return problems
+	}
+
+	var verr *envoy.ValidationError
+	if err := envoy.New(o).Validate(); errors.As(err, &verr) {
+		return verr.Problems
+	} else if err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+// EgressPolicies returns the policies of SPIRE_ENVOY_EGRESS, which map hosts to
+// `mtls[:<expected>]`, `tls`, `plaintext` or `deny`, or else the ones of
+// `envoy.egress.hosts` in buildpack.yml, and the mtls policies of SPIRE_ENVOY_UPSTREAMS,
+// which map hosts to the expected SPIFFE ID or trust domain.
+func (s *Supplier) EgressPolicies() ([]envoy.EgressPolicy, []string) {
+	var policies []envoy.EgressPolicy
+	var problems []string
+
+	hosts := s.Settings.EnvoyEgress
+	if len(hosts) == 0 {
+		hosts, problems = s.ymlEgressHosts()
+	}
+	for _, host := range sortedKeys(hosts) {
+		if p, err := envoy.ParseEgressPolicy(host, hosts[host]); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy egress %v", err))
+		} else {
+			policies = append(policies, p)
+		}
+	}
+	for _, host := range sortedKeys(s.Settings.EnvoyUpstreams) {
+		if p, err := envoy.ParseUpstream(host, s.Settings.EnvoyUpstreams[host]); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy upstream %v", err))
+		} else {
+			policies = append(policies, p)
+		}
+	}
+
+	return policies, problems
+}
+
+// ymlEgressHosts returns the policies of `envoy.egress.hosts` in buildpack.yml in the
+// form of SPIRE_ENVOY_EGRESS.
+func (s *Supplier) ymlEgressHosts() (map[string]string, []string) {
+	entries, err := ymlEntries(s.ConfigValues, ymlEgressHosts)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("envoy egress %v", err)}
+	}
+
+	hosts := map[string]string{}
+	var problems []string
+	for _, e := range entries {
+		if e.value != nil && isYmlScalar(e.value) {
+			hosts[e.key] = fmt.Sprint(e.value)
+			continue
+		}
+
+		var c EgressHostConfig
+		policy, err := "", decodeYmlEntry(e.value, &c)
+		if err == nil {
+			policy, err = c.policy()
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("envoy egress host `%s` in buildpack.yml: %v", e.key, err))
+			continue
+		}
+		hosts[e.key] = policy
+	}
+	return hosts, problems
+}
+
+// TCPTunnels returns the tunnels of SPIRE_ENVOY_TCP_TUNNELS, which map the `host:port`
+// upstreams to the local port the app connects to, optionally followed by the expected
+// SPIFFE ID or trust domain of the upstream, as in `15432:spiffe://example.org/db`, or
+// else the ones of `envoy.tcp_tunnels` in buildpack.yml.
+func (s *Supplier) TCPTunnels() ([]envoy.TCPTunnel, []string) {
+	var tunnels []envoy.TCPTunnel
+	var problems []string
+
+	upstreams := s.Settings.EnvoyTCPTunnels
+	if len(upstreams) == 0 {
+		upstreams, problems = s.ymlTCPTunnels()
+	}
+	for _, upstream := range sortedKeys(upstreams) {
+		if t, err := envoy.ParseTCPTunnel(upstream, upstreams[upstream]); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy %v", err))
+		} else {
+			tunnels = append(tunnels, t)
+		}
+	}
+
+	return tunnels, problems
+}
+
+// ymlTCPTunnels returns the tunnels of `envoy.tcp_tunnels` in buildpack.yml in the form
+// of SPIRE_ENVOY_TCP_TUNNELS.
+func (s *Supplier) ymlTCPTunnels() (map[string]string, []string) {
+	entries, err := ymlEntries(s.ConfigValues, ymlTCPTunnels)
+	if err != nil {
+		return nil, []string{fmt.Sprintf("envoy %v", err)}
+	}
+
+	upstreams := map[string]string{}
+	var problems []string
+	for _, e := range entries {
+		if port, ok := e.value.(int); ok {
+			upstreams[e.key] = strconv.Itoa(port)
+			continue
+		}
+
+		var c TCPTunnelConfig
+		tunnel, err := "", decodeYmlEntry(e.value, &c)
+		if err == nil {
+			tunnel, err = c.tunnel()
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("envoy tcp tunnel to `%s` in buildpack.yml: %v", e.key, err))
+			continue
+		}
+		upstreams[e.key] = tunnel
+	}
+	return upstreams, problems
+}
+
+// Destinations returns the overrides of SPIRE_ENVOY_DESTINATIONS, which map the hosts of
+// the egress policies and of the tcp tunnels to `;` separated overrides such as
+// `request_timeout=30s;retry_on=5xx|reset;max_retries=3;max_connections=100`, or else
+// the ones of `envoy.destinations` in buildpack.yml.
+func (s *Supplier) Destinations() (map[string]envoy.Resiliency, []string) {
+	destinations := map[string]envoy.Resiliency{}
+	var problems []string
+
+	if len(s.Settings.EnvoyDestinations) == 0 {
+		return s.ymlDestinations()
+	}
+	for _, host := range sortedKeys(s.Settings.EnvoyDestinations) {
+		if r, err := envoy.ParseResiliency(s.Settings.EnvoyDestinations[host]); err != nil {
+			problems = append(problems, fmt.Sprintf("envoy destination `%s`: %v", host, err))
+		} else {
+			destinations[host] = r
+		}
+	}
+
+	return destinations, problems
+}
+
+// ymlDestinations returns the overrides of `envoy.destinations` in buildpack.yml.
+func (s *Supplier) ymlDestinations() (map[string]envoy.Resiliency, []string) {
+	destinations := map[string]envoy.Resiliency{}
+
+	entries, err := ymlEntries(s.ConfigValues, ymlDestinations)
+	if err != nil {
+		return destinations, []string{fmt.Sprintf("envoy %v", err)}
+	}
+
+	var problems []string
+	for _, e := range entries {
+		var c DestinationConfig
+		r, err := envoy.Resiliency{}, decodeYmlEntry(e.value, &c)
+		if err == nil {
+			r, err = c.resiliency()
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("envoy destination `%s` in buildpack.yml: %v", e.key, err))
+			continue
+		}
+		destinations[e.key] = r
+	}
+	return destinations, problems
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Supplier) WriteEnvoyConfig() error {
+	config, err := envoy.New(s.EnvoyOptions()).YAML()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(s.Stager.DepDir(), "envoy-config.yaml"), config, 0644)
+}
@@ -0,0 +1,219 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/envoy"
+	"gopkg.in/yaml.v2"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func ymlSupplier(t *testing.T, buildpackYml string) *Supplier {
+	t.Helper()
+
+	var config map[string]interface{}
+	if err := yaml.Unmarshal([]byte(buildpackYml), &config); err != nil {
+		t.Fatal(err)
+	}
+	settings, _, err := ResolveSettings(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Supplier{ConfigValues: config, Settings: settings}
+}
+
+func TestEgressPoliciesYml(t *testing.T) {
+	s := ymlSupplier(t, `
+envoy:
+  egress:
+    default: tls
+    hosts:
+      api.github.com: tls
+      legacy.internal: plaintext
+      "*.example.org": mtls:example.org
+      api.example.org:
+        mode: mtls
+        spiffe_id: spiffe://example.org/api
+      db.partner.org:
+        mode: mtls
+        trust_domain: partner.org
+`)
+
+	policies, problems := s.EgressPolicies()
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	want := []envoy.EgressPolicy{
+		{Host: "*.example.org", Mode: envoy.EgressMTLS, TrustDomain: "example.org"},
+		{Host: "api.example.org", Mode: envoy.EgressMTLS, SpiffeID: "spiffe://example.org/api", TrustDomain: "example.org"},
+		{Host: "api.github.com", Mode: envoy.EgressTLS},
+		{Host: "db.partner.org", Mode: envoy.EgressMTLS, TrustDomain: "partner.org"},
+		{Host: "legacy.internal", Mode: envoy.EgressPlaintext},
+	}
+	if !reflect.DeepEqual(policies, want) {
+		t.Errorf("got policies\n%+v\nwant\n%+v", policies, want)
+	}
+
+	t.Setenv("SPIRE_ENVOY_EGRESS", "api.github.com=deny")
+	s.Settings, _, _ = ResolveSettings(s.ConfigValues, nil)
+	policies, _ = s.EgressPolicies()
+	if want := []envoy.EgressPolicy{{Host: "api.github.com", Mode: envoy.EgressDeny}}; !reflect.DeepEqual(policies, want) {
+		t.Errorf("SPIRE_ENVOY_EGRESS didn't replace the hosts of buildpack.yml: %+v", policies)
+	}
+}
+
+func TestTCPTunnelsYml(t *testing.T) {
+	s := ymlSupplier(t, `
+envoy:
+  tcp_tunnels:
+    db.example.org:5432: 15432
+    mq.example.org:5671:
+      local_port: 15671
+      spiffe_id: spiffe://example.org/mq
+`)
+
+	tunnels, problems := s.TCPTunnels()
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	want := []envoy.TCPTunnel{
+		{LocalPort: 15432, Host: "db.example.org", Port: 5432},
+		{LocalPort: 15671, Host: "mq.example.org", Port: 5671, SpiffeID: "spiffe://example.org/mq", TrustDomain: "example.org"},
+	}
+	if !reflect.DeepEqual(tunnels, want) {
+		t.Errorf("got tunnels\n%+v\nwant\n%+v", tunnels, want)
+	}
+}
+
+func TestDestinationsYml(t *testing.T) {
+	s := ymlSupplier(t, `
+envoy:
+  destinations:
+    api.example.org:
+      request_timeout: 30s
+      retry_on: [5xx, reset]
+      max_retries: 3
+      max_connections: 100
+`)
+
+	destinations, problems := s.Destinations()
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	want := map[string]envoy.Resiliency{
+		"api.example.org": {RequestTimeout: 30 * time.Second, RetryOn: []string{"5xx", "reset"}, MaxRetries: 3, MaxConnections: 100},
+	}
+	if !reflect.DeepEqual(destinations, want) {
+		t.Errorf("got destinations %+v, want %+v", destinations, want)
+	}
+}
+
+func TestWriteEnvoyConfigWithConfigUpdater(t *testing.T) {
+	s := ymlSupplier(t, `
+envoy:
+  enabled: true
+  ingress:
+    enabled: true
+  egress:
+    default: mtls
+    hosts:
+      api.example.org: mtls
+  tcp_tunnels:
+    db.example.org:5432: 15432
+`)
+	depDir := t.TempDir()
+	s.Stager = fakeStager{depDir: depDir}
+	s.Log = libbuildpack.NewLogger(io.Discard)
+
+	if problems := s.ValidateEnvoy(); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	if err := s.WriteEnvoyConfig(); err != nil {
+		t.Fatalf("the validated bootstrap can't be written: %v", err)
+	}
+	config, err := os.ReadFile(filepath.Join(depDir, "envoy-config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), "spiffe://"+runtimeTrustDomain+"/runtime") {
+		t.Errorf("expected the stand-in SPIFFE ID for the config-updater in\n%s", config)
+	}
+}
+
+func TestEnvoyYmlUnsupportedShapes(t *testing.T) {
+	tests := []struct {
+		name     string
+		yml      string
+		problems func(s *Supplier) []string
+		expected string
+	}{
+		{
+			name:     "egress hosts list",
+			yml:      "envoy: {egress: {hosts: [api.github.com]}}",
+			problems: func(s *Supplier) []string { _, p := s.EgressPolicies(); return p },
+			expected: "`envoy.egress.hosts` in buildpack.yml must be a mapping",
+		},
+		{
+			name:     "unknown egress key",
+			yml:      "envoy: {egress: {hosts: {api.example.org: {mode: mtls, spiffeid: spiffe://example.org/api}}}}",
+			problems: func(s *Supplier) []string { _, p := s.EgressPolicies(); return p },
+			expected: "egress host `api.example.org` in buildpack.yml: unknown key `spiffeid`",
+		},
+		{
+			name:     "expected identity without mtls",
+			yml:      "envoy: {egress: {hosts: {api.example.org: {mode: tls, trust_domain: example.org}}}}",
+			problems: func(s *Supplier) []string { _, p := s.EgressPolicies(); return p },
+			expected: "spiffe_id and trust_domain need the `mtls` mode",
+		},
+		{
+			name:     "egress host without policy",
+			yml:      "envoy: {egress: {hosts: {api.example.org: }}}",
+			problems: func(s *Supplier) []string { _, p := s.EgressPolicies(); return p },
+			expected: "egress host `api.example.org` in buildpack.yml: has no value",
+		},
+		{
+			name:     "tunnel local port list",
+			yml:      "envoy: {tcp_tunnels: {db.example.org:5432: {local_port: [15432]}}}",
+			problems: func(s *Supplier) []string { _, p := s.TCPTunnels(); return p },
+			expected: "tcp tunnel to `db.example.org:5432` in buildpack.yml",
+		},
+		{
+			name:     "tunnel with both identities",
+			yml:      "envoy: {tcp_tunnels: {db.example.org:5432: {local_port: 15432, spiffe_id: spiffe://example.org/db, trust_domain: example.org}}}",
+			problems: func(s *Supplier) []string { _, p := s.TCPTunnels(); return p },
+			expected: "set either spiffe_id or trust_domain",
+		},
+		{
+			name:     "destination string",
+			yml:      "envoy: {destinations: {api.example.org: request_timeout=30s}}",
+			problems: func(s *Supplier) []string { _, p := s.Destinations(); return p },
+			expected: "destination `api.example.org` in buildpack.yml: must be a mapping",
+		},
+		{
+			name:     "destination retry_on string",
+			yml:      "envoy: {destinations: {api.example.org: {retry_on: {5xx: true}}}}",
+			problems: func(s *Supplier) []string { _, p := s.Destinations(); return p },
+			expected: "destination `api.example.org` in buildpack.yml: cannot unmarshal !!map into []string",
+		},
+		{
+			name:     "destination timeout",
+			yml:      "envoy: {destinations: {api.example.org: {request_timeout: soon}}}",
+			problems: func(s *Supplier) []string { _, p := s.Destinations(); return p },
+			expected: "value `soon` of `request_timeout` is invalid",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := test.problems(ymlSupplier(t, test.yml))
+			if len(problems) != 1 || !strings.Contains(problems[0], test.expected) {
+				t.Errorf("expected a problem containing %q, got %q", test.expected, problems)
+			}
+		})
+	}
+}
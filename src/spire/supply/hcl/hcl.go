@@ -0,0 +1,165 @@
+// Package hcl writes HCL documents in the dialect read by the SPIRE agent (HCL 1).
+package hcl
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const indentation = "  "
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// Writer builds an HCL document out of blocks and attributes.
+type Writer struct {
+	buf    bytes.Buffer
+	indent int
+}
+
+// Block writes `name "label" ... { body }`.
+func (w *Writer) Block(name string, labels []string, body func(w *Writer)) {
+	w.line(Key(name))
+	for _, label := range labels {
+		w.buf.WriteString(" ")
+		w.buf.WriteString(Quote(label))
+	}
+	w.buf.WriteString(" {\n")
+
+	w.indent++
+	if body != nil {
+		body(w)
+	}
+	w.indent--
+
+	w.line("}\n")
+}
+
+// Attr writes `name = value`.
+func (w *Writer) Attr(name string, value interface{}) {
+	w.line(fmt.Sprintf("%s = %s\n", Key(name), Value(value)))
+}
+
+// Attrs writes the entries of the map sorted by key; nested maps are written as blocks.
+func (w *Writer) Attrs(values map[string]interface{}) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if nested, ok := toStringMap(values[k]); ok {
+			w.Block(k, nil, func(w *Writer) {
+				w.Attrs(nested)
+			})
+			continue
+		}
+		w.Attr(k, values[k])
+	}
+}
+
+// Blank writes an empty line.
+func (w *Writer) Blank() {
+	w.buf.WriteString("\n")
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *Writer) String() string {
+	return w.buf.String()
+}
+
+func (w *Writer) line(s string) {
+	w.buf.WriteString(strings.Repeat(indentation, w.indent))
+	w.buf.WriteString(s)
+}
+
+// Quote returns the string as a quoted HCL string. Besides the usual escapes, `${` is
+// escaped since HCL 1 treats it as the start of an interpolation in which quotes don't
+// terminate the string.
+func Quote(s string) string {
+	return strings.ReplaceAll(strconv.Quote(s), "${", `\u0024{`)
+}
+
+// Key returns the name as is when it is an identifier, and quoted otherwise.
+func Key(name string) string {
+	if identifierRegexp.MatchString(name) {
+		return name
+	}
+	return Quote(name)
+}
+
+// Value renders strings, booleans, numbers, lists and maps as HCL values.
+func Value(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return `""`
+	case string:
+		return Quote(value)
+	case bool:
+		return strconv.FormatBool(value)
+	case int:
+		return strconv.Itoa(value)
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case uint64:
+		return strconv.FormatUint(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case []string:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, Quote(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			items = append(items, Value(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case []map[string]interface{}:
+		items := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			items = append(items, item)
+		}
+		return Value(items)
+	}
+
+	if m, ok := toStringMap(v); ok {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fields := make([]string, 0, len(keys))
+		for _, k := range keys {
+			fields = append(fields, fmt.Sprintf("%s = %s", Key(k), Value(m[k])))
+		}
+		return "{ " + strings.Join(fields, ", ") + " }"
+	}
+
+	return Quote(fmt.Sprint(v))
+}
+
+// toStringMap normalizes maps, including the ones decoded from YAML.
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			converted[fmt.Sprint(k)] = v
+		}
+		return converted, true
+	}
+	return nil, false
+}
@@ -0,0 +1,210 @@
+package supply
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"regexp"
+)
+
+var processTypeRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+const (
+	spireAgentProcess    = "spire_agent"
+	envoyProxyProcess    = "app-proxy-envoy"
+	svidFileProcess      = "svid-file-script"
+	configUpdaterProcess = "config-updater"
+
+	defaultSidecarFor = "web"
+)
+
+// Launch is the content of launch.yml; the processes are declared as sidecars of the
+// application processes.
+type Launch struct {
+	Processes []Process `yaml:"processes"`
+}
+
+type Process struct {
+	Type      string    `yaml:"type"`
+	Command   string    `yaml:"command"`
+	Limits    *Limits   `yaml:"limits,omitempty"`
+	Platforms Platforms `yaml:"platforms"`
+}
+
+// Limits holds the resource limits of a sidecar; Memory is in MB.
+type Limits struct {
+	Memory int `yaml:"memory,omitempty"`
+}
+
+type Platforms struct {
+	CloudFoundry CloudFoundryPlatform `yaml:"cloudfoundry"`
+}
+
+type CloudFoundryPlatform struct {
+	SidecarFor []string `yaml:"sidecar_for"`
+}
+
+// NewSidecar returns a sidecar process of the given application process types; it is
+// a sidecar of the web process when none are given.
+func NewSidecar(processType, command string, sidecarFor ...string) Process {
+	if len(sidecarFor) == 0 {
+		sidecarFor = []string{defaultSidecarFor}
+	}
+	return Process{
+		Type:      processType,
+		Command:   command,
+		Platforms: Platforms{CloudFoundry: CloudFoundryPlatform{SidecarFor: sidecarFor}},
+	}
+}
+
+// SidecarFor returns the application process types the process is a sidecar of.
+func (p Process) SidecarFor() []string {
+	return p.Platforms.CloudFoundry.SidecarFor
+}
+
+// Process returns the process with the given type, or nil.
+func (l *Launch) Process(processType string) *Process {
+	for i := range l.Processes {
+		if l.Processes[i].Type == processType {
+			return &l.Processes[i]
+		}
+	}
+	return nil
+}
+
+// Add appends the process, or replaces the process with the same type.
+func (l *Launch) Add(p Process) {
+	if existing := l.Process(p.Type); existing != nil {
+		*existing = p
+		return
+	}
+	l.Processes = append(l.Processes, p)
+}
+
+// Remove removes the process with the given type and reports whether it was present.
+func (l *Launch) Remove(processType string) bool {
+	for i, p := range l.Processes {
+		if p.Type == processType {
+			l.Processes = append(l.Processes[:i], l.Processes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Launch) Validate() error {
+	seen := map[string]struct{}{}
+	for _, p := range l.Processes {
+		if p.Type == "" {
+			return fmt.Errorf("sidecar process without type")
+		}
+		if _, ok := seen[p.Type]; ok {
+			return fmt.Errorf("duplicated sidecar process `%s`", p.Type)
+		}
+		seen[p.Type] = struct{}{}
+		if p.Command == "" {
+			return fmt.Errorf("sidecar process `%s` has no command", p.Type)
+		}
+		if len(p.SidecarFor()) == 0 {
+			return fmt.Errorf("sidecar process `%s` is not a sidecar of any process", p.Type)
+		}
+		if p.Limits != nil && p.Limits.Memory < 0 {
+			return fmt.Errorf("sidecar process `%s` has a negative memory limit", p.Type)
+		}
+	}
+	return nil
+}
+
+func (l *Launch) Marshal() ([]byte, error) {
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("---\n"), data...), nil
+}
+
+func (l *Launch) Write(path string) error {
+	data, err := l.Marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func ParseLaunch(data []byte) (*Launch, error) {
+	l := &Launch{}
+	if err := yaml.UnmarshalStrict(data, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func ReadLaunch(path string) (*Launch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseLaunch(data)
+}
+
+// sidecarOptions returns the process types and the memory limit, in MB, of the given
+// sidecar; the process types default to SidecarFor and a zero limit means no limit.
+func (s Settings) sidecarOptions(processType string) ([]string, int) {
+	var sidecarFor []string
+	var memory int
+
+	switch processType {
+	case spireAgentProcess:
+		sidecarFor, memory = s.AgentSidecarFor, s.AgentSidecarMemory
+	case envoyProxyProcess:
+		sidecarFor, memory = s.EnvoySidecarFor, s.EnvoySidecarMemory
+	case svidFileProcess:
+		sidecarFor, memory = s.SVIDStoreSidecarFor, s.SVIDStoreSidecarMemory
+	case configUpdaterProcess:
+		sidecarFor, memory = s.UpdaterSidecarFor, s.UpdaterSidecarMemory
+	}
+
+	if len(sidecarFor) == 0 {
+		sidecarFor = s.SidecarFor
+	}
+	return sidecarFor, memory
+}
+
+func (s *Supplier) sidecar(processType, command string) Process {
+	sidecarFor, memory := s.Settings.sidecarOptions(processType)
+
+	p := NewSidecar(processType, command, sidecarFor...)
+	if memory != 0 {
+		p.Limits = &Limits{Memory: memory}
+	}
+	return p
+}
+
+// ValidateSidecars checks the process types and the memory limits of the sidecars.
+// The process types are checked against the ones the app declares when they are known.
+func (s *Supplier) ValidateSidecars() []string {
+	var problems []string
+
+	declared, known, err := s.DeclaredProcessTypes()
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("can't read the app's process types: %v", err))
+	}
+
+	for _, p := range s.Launch(s.Credentials).Processes {
+		if p.Limits != nil && p.Limits.Memory < 0 {
+			problems = append(problems, fmt.Sprintf("memory limit %d of sidecar `%s` is negative", p.Limits.Memory, p.Type))
+		}
+		for _, processType := range p.SidecarFor() {
+			if !processTypeRegexp.MatchString(processType) {
+				problems = append(problems, fmt.Sprintf("sidecar `%s` targets invalid process type `%s`", p.Type, processType))
+			} else if _, ok := declared[processType]; known && !ok {
+				problems = append(problems, fmt.Sprintf("sidecar `%s` targets process type `%s` which the Procfile doesn't declare", p.Type, processType))
+			}
+		}
+	}
+
+	return problems
+}
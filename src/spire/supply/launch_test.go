@@ -0,0 +1,184 @@
+package supply
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLaunchRoundTrip(t *testing.T) {
+	launch := &Launch{}
+	launch.Add(NewSidecar(spireAgentProcess, "/home/vcap/deps/0/bin/spire-agent run -config /home/vcap/deps/0/spire-agent.conf"))
+	launch.Add(NewSidecar(svidFileProcess, "mkdir -p /tmp/a && while (true); do echo 'Refresh: \"SVID\"' # not a comment; done", "web", "worker"))
+
+	envoy := NewSidecar(envoyProxyProcess, "/etc/cf-assets/envoy/envoy -c /home/vcap/deps/0/envoy-config.yaml --log-level info")
+	envoy.Limits = &Limits{Memory: 256}
+	launch.Add(envoy)
+
+	path := filepath.Join(t.TempDir(), "launch.yml")
+	if err := launch.Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadLaunch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, launch) {
+		t.Errorf("round trip mismatch\n got: %+v\nwant: %+v", got, launch)
+	}
+}
+
+func TestLaunchAddRemove(t *testing.T) {
+	launch := &Launch{}
+	launch.Add(NewSidecar("a", "run a"))
+	launch.Add(NewSidecar("b", "run b"))
+	launch.Add(NewSidecar("a", "run a again", "worker"))
+
+	if len(launch.Processes) != 2 {
+		t.Fatalf("expected 2 processes, got %d", len(launch.Processes))
+	}
+	if p := launch.Process("a"); p == nil || p.Command != "run a again" || !reflect.DeepEqual(p.SidecarFor(), []string{"worker"}) {
+		t.Errorf("process `a` wasn't replaced: %+v", p)
+	}
+
+	if !launch.Remove("a") {
+		t.Error("expected `a` to be removed")
+	}
+	if launch.Remove("a") {
+		t.Error("`a` was removed twice")
+	}
+	if len(launch.Processes) != 1 || launch.Processes[0].Type != "b" {
+		t.Errorf("unexpected processes: %+v", launch.Processes)
+	}
+}
+
+func TestLaunchMarshal(t *testing.T) {
+	launch := &Launch{}
+	launch.Add(NewSidecar(spireAgentProcess, "spire-agent run"))
+
+	data, err := launch.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `---
+processes:
+- type: spire_agent
+  command: spire-agent run
+  platforms:
+    cloudfoundry:
+      sidecar_for:
+      - web
+`
+	if string(data) != want {
+		t.Errorf("got\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestLaunchValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		process Process
+		err     string
+	}{
+		{"no type", NewSidecar("", "run"), "without type"},
+		{"no command", NewSidecar("a", ""), "no command"},
+		{"no sidecar_for", Process{Type: "a", Command: "run"}, "not a sidecar"},
+		{"negative memory", Process{Type: "a", Command: "run", Limits: &Limits{Memory: -1},
+			Platforms: Platforms{CloudFoundry: CloudFoundryPlatform{SidecarFor: []string{"web"}}}}, "negative memory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			launch := &Launch{Processes: []Process{tt.process}}
+			if _, err := launch.Marshal(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing `%s`, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestParseLaunchRejectsUnknownFields(t *testing.T) {
+	_, err := ParseLaunch([]byte("processes:\n- type: a\n  comand: run\n"))
+	if err == nil {
+		t.Error("expected an error for the misspelled field")
+	}
+}
+
+func TestSidecarOptions(t *testing.T) {
+	settings := Settings{
+		SidecarFor:         []string{"web", "worker"},
+		EnvoySidecarFor:    []string{"web"},
+		EnvoySidecarMemory: 128,
+		AgentSidecarMemory: 64,
+	}
+
+	s := &Supplier{Settings: settings}
+
+	agent := s.sidecar(spireAgentProcess, "run")
+	if !reflect.DeepEqual(agent.SidecarFor(), []string{"web", "worker"}) || agent.Limits == nil || agent.Limits.Memory != 64 {
+		t.Errorf("unexpected spire agent sidecar: %+v", agent)
+	}
+
+	envoy := s.sidecar(envoyProxyProcess, "run")
+	if !reflect.DeepEqual(envoy.SidecarFor(), []string{"web"}) || envoy.Limits == nil || envoy.Limits.Memory != 128 {
+		t.Errorf("unexpected envoy sidecar: %+v", envoy)
+	}
+
+	updater := s.sidecar(configUpdaterProcess, "run")
+	if updater.Limits != nil {
+		t.Errorf("expected no limits, got %+v", updater.Limits)
+	}
+}
+
+func TestLaunchIngressUsesAppPort(t *testing.T) {
+	s := &Supplier{
+		Stager:   fakeStager{},
+		Settings: Settings{EnvoyProxy: true, EnvoyIngress: true, EnvoyLogLevel: "info"},
+	}
+
+	envoy := s.Launch(&Credentials{}).Process(envoyProxyProcess)
+	if envoy == nil {
+		t.Fatal("no envoy sidecar")
+	}
+	if !strings.HasPrefix(envoy.Command, `sed -i "/cluster_name: local_app/`) || !strings.Contains(envoy.Command, "${PORT:-") {
+		t.Errorf("expected the envoy command to rewrite the app port, got %s", envoy.Command)
+	}
+
+	s.Settings.EnvoyIngress = false
+	if envoy := s.Launch(&Credentials{}).Process(envoyProxyProcess); strings.Contains(envoy.Command, "sed") {
+		t.Errorf("expected no rewrite without ingress, got %s", envoy.Command)
+	}
+}
+
+func TestValidateSidecars(t *testing.T) {
+	buildDir := t.TempDir()
+
+	s := &Supplier{
+		Stager:      fakeStager{buildDir: buildDir},
+		Credentials: &Credentials{},
+		Settings: Settings{
+			SidecarFor:         []string{"web", "worker"},
+			AgentSidecarMemory: -1,
+			EnvoyProxy:         true,
+			EnvoySidecarFor:    []string{"web", "bad type"},
+		},
+	}
+
+	problems := s.ValidateSidecars()
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems without a Procfile, got %q", problems)
+	}
+
+	if err := os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte("scheduler: ./scheduler\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems = s.ValidateSidecars()
+	if len(problems) != 3 || !strings.Contains(problems[1], "`worker` which the Procfile doesn't declare") {
+		t.Errorf("expected the undeclared worker process to be reported, got %q", problems)
+	}
+}
@@ -0,0 +1,91 @@
+package supply
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	nodeAttestorCfIic     = "cf_iic"
+	nodeAttestorJoinToken = "join_token"
+	nodeAttestorX509pop   = "x509pop"
+)
+
+// NodeAttestorPlugin returns the NodeAttestor plugin selected in the settings.
+func (s *Supplier) NodeAttestorPlugin() (PluginConfig, error) {
+	switch s.Settings.NodeAttestor {
+	case nodeAttestorCfIic:
+		return PluginConfig{
+			Type:      "NodeAttestor",
+			Name:      nodeAttestorCfIic,
+			PluginCmd: path.Join("/home/vcap/deps", s.Stager.DepsIdx(), "bin", "cf_iic"),
+			PluginData: map[string]interface{}{
+				"private_key_path": s.Settings.NodeAttestorKeyPath,
+				"certificate_path": s.Settings.NodeAttestorCertPath,
+			},
+		}, nil
+	case nodeAttestorJoinToken:
+		return PluginConfig{Type: "NodeAttestor", Name: nodeAttestorJoinToken}, nil
+	case nodeAttestorX509pop:
+		data := map[string]interface{}{
+			"private_key_path": s.Settings.NodeAttestorKeyPath,
+			"certificate_path": s.Settings.NodeAttestorCertPath,
+		}
+		if s.Settings.NodeAttestorChainPath != "" {
+			data["intermediates_path"] = s.Settings.NodeAttestorChainPath
+		}
+		return PluginConfig{Type: "NodeAttestor", Name: nodeAttestorX509pop, PluginData: data}, nil
+	}
+
+	return PluginConfig{}, fmt.Errorf("unsupported node attestor `%s`; use `%s`, `%s` or `%s`",
+		s.Settings.NodeAttestor, nodeAttestorCfIic, nodeAttestorJoinToken, nodeAttestorX509pop)
+}
+
+// ValidateNodeAttestor checks the settings the selected node attestor depends on.
+func (s *Supplier) ValidateNodeAttestor() []string {
+	var problems []string
+
+	switch s.Settings.NodeAttestor {
+	case nodeAttestorCfIic, nodeAttestorX509pop:
+		paths := []struct {
+			name     string
+			path     string
+			optional bool
+		}{
+			{name: "private key path", path: s.Settings.NodeAttestorKeyPath},
+			{name: "certificate path", path: s.Settings.NodeAttestorCertPath},
+			{name: "intermediates path", path: s.Settings.NodeAttestorChainPath, optional: true},
+		}
+		for _, p := range paths {
+			if p.path == "" && p.optional {
+				continue
+			}
+			if !path.IsAbs(p.path) {
+				problems = append(problems, fmt.Sprintf("%s node attestor %s `%s` must be an absolute path", s.Settings.NodeAttestor, p.name, p.path))
+				continue
+			}
+			// Files shipped with the app can be checked already; others only exist at runtime.
+			if strings.HasPrefix(p.path, appDir+"/") {
+				file := filepath.Join(s.Stager.BuildDir(), strings.TrimPrefix(p.path, appDir+"/"))
+				if _, err := os.Stat(file); err != nil {
+					problems = append(problems, fmt.Sprintf("%s node attestor %s %s is not in the app: %v", s.Settings.NodeAttestor, p.name, p.path, err))
+				}
+			}
+		}
+	case nodeAttestorJoinToken:
+		if s.Settings.JoinToken == "" {
+			problems = append(problems, "join_token node attestor needs a token; add `join_token` to the binding credentials or set SPIRE_JOIN_TOKEN")
+		} else if strings.ContainsAny(s.Settings.JoinToken, " \t\r\n\"") {
+			problems = append(problems, "join token contains whitespace or quotes")
+		}
+	default:
+		if _, err := s.NodeAttestorPlugin(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems
+}
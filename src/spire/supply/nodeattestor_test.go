@@ -0,0 +1,104 @@
+package supply
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateNodeAttestor(t *testing.T) {
+	buildDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(buildDir, "certs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"node.key", "node.crt"} {
+		if err := os.WriteFile(filepath.Join(buildDir, "certs", name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		settings Settings
+		problems []string
+	}{
+		{
+			name:     "join token",
+			settings: Settings{NodeAttestor: nodeAttestorJoinToken, JoinToken: "2c7e2d04-1c8a-4f3c-9c2b-3c1b5c6d7e8f"},
+		},
+		{
+			name:     "missing join token",
+			settings: Settings{NodeAttestor: nodeAttestorJoinToken},
+			problems: []string{"join_token node attestor needs a token"},
+		},
+		{
+			name:     "join token with whitespace",
+			settings: Settings{NodeAttestor: nodeAttestorJoinToken, JoinToken: "a token"},
+			problems: []string{"join token contains whitespace"},
+		},
+		{
+			name: "x509pop files in the app",
+			settings: Settings{
+				NodeAttestor:         nodeAttestorX509pop,
+				NodeAttestorKeyPath:  "/home/vcap/app/certs/node.key",
+				NodeAttestorCertPath: "/home/vcap/app/certs/node.crt",
+			},
+		},
+		{
+			name: "x509pop files outside of the app",
+			settings: Settings{
+				NodeAttestor:         nodeAttestorX509pop,
+				NodeAttestorKeyPath:  "/etc/cf-instance-credentials/instance.key",
+				NodeAttestorCertPath: "/etc/cf-instance-credentials/instance.crt",
+			},
+		},
+		{
+			name: "missing x509pop files",
+			settings: Settings{
+				NodeAttestor:          nodeAttestorX509pop,
+				NodeAttestorKeyPath:   "/home/vcap/app/certs/missing.key",
+				NodeAttestorCertPath:  "/home/vcap/app/certs/missing.crt",
+				NodeAttestorChainPath: "/home/vcap/app/certs/chain.crt",
+			},
+			problems: []string{
+				"private key path /home/vcap/app/certs/missing.key is not in the app",
+				"certificate path /home/vcap/app/certs/missing.crt is not in the app",
+				"intermediates path /home/vcap/app/certs/chain.crt is not in the app",
+			},
+		},
+		{
+			name: "relative x509pop paths",
+			settings: Settings{
+				NodeAttestor:         nodeAttestorX509pop,
+				NodeAttestorKeyPath:  "certs/node.key",
+				NodeAttestorCertPath: "",
+			},
+			problems: []string{
+				"private key path `certs/node.key` must be an absolute path",
+				"certificate path `` must be an absolute path",
+			},
+		},
+		{
+			name:     "unknown attestor",
+			settings: Settings{NodeAttestor: "aws_iid"},
+			problems: []string{"unsupported node attestor `aws_iid`"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Supplier{Stager: fakeStager{buildDir: buildDir}, Settings: test.settings}
+
+			problems := s.ValidateNodeAttestor()
+			if len(problems) != len(test.problems) {
+				t.Fatalf("got problems %q, want %q", problems, test.problems)
+			}
+			for i, p := range test.problems {
+				if !strings.Contains(problems[i], p) {
+					t.Errorf("problem %q doesn't contain %q", problems[i], p)
+				}
+			}
+		})
+	}
+}
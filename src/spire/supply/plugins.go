@@ -0,0 +1,143 @@
+package supply
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const appDir = "/home/vcap/app"
+
+// singletonPluginTypes may only be configured once in the agent.
+var singletonPluginTypes = map[string]struct{}{
+	"KeyManager":   {},
+	"NodeAttestor": {},
+}
+
+// PluginConfig is a plugin declared in the `spire-agent.plugins` section of buildpack.yml.
+// Entries matching a built-in plugin by type and name are merged into it, their
+// plugin_cmd, plugin_checksum and plugin_data keys overriding the built-in ones; other
+// entries are added to the agent. A relative plugin_cmd is a path in the app.
+type PluginConfig struct {
+	Type           string                 `yaml:"type"`
+	Name           string                 `yaml:"name"`
+	PluginCmd      string                 `yaml:"plugin_cmd"`
+	PluginChecksum string                 `yaml:"plugin_checksum"`
+	PluginData     map[string]interface{} `yaml:"plugin_data"`
+}
+
+func (p PluginConfig) key() string {
+	return p.Type + " \"" + p.Name + "\""
+}
+
+// AgentPlugins returns the built-in plugins merged with the plugins from buildpack.yml.
+func (s *Supplier) AgentPlugins() ([]PluginConfig, error) {
+	_, dataDir, err := s.DataDir()
+	if err != nil {
+		return nil, err
+	}
+
+	binDir := path.Join("/home/vcap/deps", s.Stager.DepsIdx(), "bin")
+
+	var plugins []PluginConfig
+	if s.Settings.KeyManager == keyManagerDisk {
+		plugins = append(plugins, PluginConfig{
+			Type:       "KeyManager",
+			Name:       keyManagerDisk,
+			PluginData: map[string]interface{}{"directory": dataDir},
+		})
+	} else {
+		plugins = append(plugins, PluginConfig{Type: "KeyManager", Name: keyManagerMemory})
+	}
+
+	nodeAttestor, err := s.NodeAttestorPlugin()
+	if err != nil {
+		return nil, err
+	}
+	plugins = append(plugins, nodeAttestor)
+
+	if s.Settings.SVIDStore {
+		plugins = append(plugins, PluginConfig{
+			Type:       "SVIDStore",
+			Name:       "cf",
+			PluginCmd:  path.Join(binDir, "svidstore_file"),
+			PluginData: map[string]interface{}{"write_path": "/tmp/spire-agent"},
+		})
+	}
+
+	plugins = append(plugins, PluginConfig{Type: "WorkloadAttestor", Name: "unix"})
+
+	seen := map[string]struct{}{}
+	for _, p := range s.Config.SpireAgent.Plugins {
+		if p.Type == "" || p.Name == "" {
+			return nil, fmt.Errorf("plugins in buildpack.yml need a type and a name")
+		}
+		if _, ok := seen[p.key()]; ok {
+			return nil, fmt.Errorf("plugin %s is declared more than once in buildpack.yml", p.key())
+		}
+		seen[p.key()] = struct{}{}
+
+		if p.PluginCmd != "" && !path.IsAbs(p.PluginCmd) {
+			p.PluginCmd = path.Join(appDir, p.PluginCmd)
+		}
+
+		merged := false
+		for i := range plugins {
+			if plugins[i].Type == p.Type && plugins[i].Name == p.Name {
+				plugins[i] = mergePlugin(plugins[i], p)
+				merged = true
+			}
+		}
+		if merged {
+			continue
+		}
+
+		if _, ok := singletonPluginTypes[p.Type]; ok {
+			return nil, fmt.Errorf("plugin %s conflicts with the configured %s; only one %s is allowed", p.key(), p.Type, p.Type)
+		}
+		plugins = append(plugins, p)
+	}
+
+	return plugins, nil
+}
+
+func mergePlugin(builtin, p PluginConfig) PluginConfig {
+	if p.PluginCmd != "" {
+		builtin.PluginCmd = p.PluginCmd
+	}
+	if p.PluginChecksum != "" {
+		builtin.PluginChecksum = p.PluginChecksum
+	}
+
+	data := map[string]interface{}{}
+	for k, v := range builtin.PluginData {
+		data[k] = v
+	}
+	for k, v := range p.PluginData {
+		data[k] = v
+	}
+	builtin.PluginData = data
+	return builtin
+}
+
+// ValidatePluginBinaries checks that the plugin binaries pointing into the app droplet
+// exist and are executable.
+func (s *Supplier) ValidatePluginBinaries(plugins []PluginConfig) []string {
+	var problems []string
+	for _, p := range plugins {
+		if !strings.HasPrefix(p.PluginCmd, appDir+"/") {
+			continue
+		}
+
+		binary := filepath.Join(s.Stager.BuildDir(), strings.TrimPrefix(p.PluginCmd, appDir+"/"))
+		info, err := os.Stat(binary)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("plugin binary %s of %s is not in the app: %v", p.PluginCmd, p.key(), err))
+		} else if info.IsDir() || info.Mode()&0111 == 0 {
+			problems = append(problems, fmt.Sprintf("plugin binary %s of %s is not executable", p.PluginCmd, p.key()))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,192 @@
+package supply
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAgentPlugins(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		plugins  []PluginConfig
+		expected []string
+		err      string
+	}{
+		{
+			name:     "built-in",
+			settings: Settings{KeyManager: keyManagerDisk},
+			expected: []string{`KeyManager "disk"`, `NodeAttestor "join_token"`, `WorkloadAttestor "unix"`},
+		},
+		{
+			name: "added plugin",
+			plugins: []PluginConfig{
+				{Type: "WorkloadAttestor", Name: "docker"},
+			},
+			expected: []string{`KeyManager "memory"`, `NodeAttestor "join_token"`, `WorkloadAttestor "unix"`, `WorkloadAttestor "docker"`},
+		},
+		{
+			name:     "merged plugin",
+			settings: Settings{SVIDStore: true},
+			plugins: []PluginConfig{
+				{Type: "SVIDStore", Name: "cf", PluginData: map[string]interface{}{"write_path": "/tmp/svids"}},
+			},
+			expected: []string{`KeyManager "memory"`, `NodeAttestor "join_token"`, `SVIDStore "cf"`, `WorkloadAttestor "unix"`},
+		},
+		{
+			name:    "duplicate plugin",
+			plugins: []PluginConfig{{Type: "WorkloadAttestor", Name: "docker"}, {Type: "WorkloadAttestor", Name: "docker"}},
+			err:     "declared more than once",
+		},
+		{
+			name:    "second key manager",
+			plugins: []PluginConfig{{Type: "KeyManager", Name: keyManagerDisk}},
+			err:     "only one KeyManager is allowed",
+		},
+		{
+			name:    "second node attestor",
+			plugins: []PluginConfig{{Type: "NodeAttestor", Name: nodeAttestorX509pop}},
+			err:     "only one NodeAttestor is allowed",
+		},
+		{
+			name:    "plugin without name",
+			plugins: []PluginConfig{{Type: "WorkloadAttestor"}},
+			err:     "need a type and a name",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := test.settings
+			settings.DataDirRoot, settings.DataDir, settings.NodeAttestor = dataDirRootDeps, "spire-agent-data", nodeAttestorJoinToken
+			s := &Supplier{
+				Stager:   fakeStager{},
+				Settings: settings,
+				Config:   Config{SpireAgent: SpireAgentConfig{Plugins: test.plugins}},
+			}
+
+			plugins, err := s.AgentPlugins()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var keys []string
+			for _, p := range plugins {
+				keys = append(keys, p.key())
+			}
+			if !reflect.DeepEqual(keys, test.expected) {
+				t.Errorf("got plugins %q, want %q", keys, test.expected)
+			}
+		})
+	}
+}
+
+func TestAgentPluginsCmd(t *testing.T) {
+	s := &Supplier{
+		Stager:   fakeStager{},
+		Settings: Settings{DataDirRoot: dataDirRootDeps, DataDir: "spire-agent-data", NodeAttestor: nodeAttestorJoinToken},
+		Config: Config{SpireAgent: SpireAgentConfig{Plugins: []PluginConfig{
+			{Type: "WorkloadAttestor", Name: "relative", PluginCmd: "bin/attestor"},
+			{Type: "WorkloadAttestor", Name: "absolute", PluginCmd: "/opt/attestor"},
+			{Type: "NodeAttestor", Name: "join_token", PluginCmd: "bin/join_token"},
+		}}},
+	}
+
+	plugins, err := s.AgentPlugins()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := map[string]string{}
+	for _, p := range plugins {
+		cmds[p.Name] = p.PluginCmd
+	}
+	if cmds["relative"] != "/home/vcap/app/bin/attestor" {
+		t.Errorf("relative plugin_cmd wasn't resolved in the app dir: %s", cmds["relative"])
+	}
+	if cmds["absolute"] != "/opt/attestor" {
+		t.Errorf("absolute plugin_cmd was changed: %s", cmds["absolute"])
+	}
+	if cmds["join_token"] != "/home/vcap/app/bin/join_token" {
+		t.Errorf("relative plugin_cmd of a built-in plugin wasn't resolved in the app dir: %s", cmds["join_token"])
+	}
+}
+
+func TestMergePlugin(t *testing.T) {
+	builtin := PluginConfig{
+		Type:       "SVIDStore",
+		Name:       "cf",
+		PluginCmd:  "/home/vcap/deps/0/bin/svidstore_file",
+		PluginData: map[string]interface{}{"write_path": "/tmp/spire-agent", "mode": "0600"},
+	}
+	p := PluginConfig{
+		Type:           "SVIDStore",
+		Name:           "cf",
+		PluginCmd:      "/home/vcap/app/other",
+		PluginChecksum: "abc123",
+		PluginData:     map[string]interface{}{"write_path": "/tmp/svids"},
+	}
+
+	merged := mergePlugin(builtin, p)
+	if want := map[string]interface{}{"write_path": "/tmp/svids", "mode": "0600"}; !reflect.DeepEqual(merged.PluginData, want) {
+		t.Errorf("got plugin data %v, want %v", merged.PluginData, want)
+	}
+	if merged.PluginCmd != p.PluginCmd || merged.PluginChecksum != p.PluginChecksum {
+		t.Errorf("got plugin_cmd %s and plugin_checksum %s, want the ones from buildpack.yml", merged.PluginCmd, merged.PluginChecksum)
+	}
+	if merged = mergePlugin(builtin, PluginConfig{Type: "SVIDStore", Name: "cf"}); merged.PluginCmd != builtin.PluginCmd {
+		t.Errorf("plugin_cmd of the built-in plugin was replaced by an unset one: %s", merged.PluginCmd)
+	}
+	if builtin.PluginData["write_path"] != "/tmp/spire-agent" {
+		t.Error("the built-in plugin data was modified")
+	}
+}
+
+func TestValidatePluginBinaries(t *testing.T) {
+	buildDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(buildDir, "bin", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "bin", "exec"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(buildDir, "bin", "noexec"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cmd string
+		err string
+	}{
+		{cmd: "/home/vcap/app/bin/exec"},
+		{cmd: "/home/vcap/deps/0/bin/cf_iic"},
+		{cmd: "/opt/attestor"},
+		{cmd: "/home/vcap/app/bin/missing", err: "is not in the app"},
+		{cmd: "/home/vcap/app/bin/noexec", err: "is not executable"},
+		{cmd: "/home/vcap/app/bin/dir", err: "is not executable"},
+	}
+
+	s := &Supplier{Stager: fakeStager{buildDir: buildDir}}
+	for _, test := range tests {
+		t.Run(test.cmd, func(t *testing.T) {
+			problems := s.ValidatePluginBinaries([]PluginConfig{{Type: "WorkloadAttestor", Name: "test", PluginCmd: test.cmd}})
+			if test.err == "" {
+				if len(problems) != 0 {
+					t.Errorf("unexpected problems: %q", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0], test.err) {
+				t.Errorf("expected a problem containing %q, got %q", test.err, problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package supply
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadProcfile returns the commands of the process types declared in the app's
+// Procfile; it is nil when the app has no Procfile. Blank lines, `#` comments and
+// lines without a valid process type are skipped.
+func ReadProcfile(buildDir string) (map[string]string, error) {
+	procfile, err := os.Open(filepath.Join(buildDir, "Procfile"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer procfile.Close()
+
+	processes := map[string]string{}
+	scanner := bufio.NewScanner(procfile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, command, found := strings.Cut(line, ":")
+		if name = strings.TrimSpace(name); found && processTypeRegexp.MatchString(name) {
+			processes[name] = strings.TrimSpace(command)
+		}
+	}
+
+	return processes, scanner.Err()
+}
+
+// DeclaredProcessTypes returns the process types the app declares, and whether they
+// are known at staging time. They are only known when the app has a Procfile; the web
+// process always exists.
+func (s *Supplier) DeclaredProcessTypes() (map[string]struct{}, bool, error) {
+	procfile, err := ReadProcfile(s.Stager.BuildDir())
+	if err != nil || procfile == nil {
+		return nil, false, err
+	}
+
+	types := map[string]struct{}{defaultSidecarFor: {}}
+	for name := range procfile {
+		types[name] = struct{}{}
+	}
+	return types, true, nil
+}
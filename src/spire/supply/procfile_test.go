@@ -0,0 +1,41 @@
+package supply
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadProcfile(t *testing.T) {
+	buildDir := t.TempDir()
+	if procfile, err := ReadProcfile(buildDir); err != nil || procfile != nil {
+		t.Errorf("expected no processes without a Procfile, got %v, %v", procfile, err)
+	}
+
+	procfile := `# Processes: web serves http, worker runs jobs
+web: ./server --port $PORT
+
+  # note: the worker needs the queue
+worker:bundle exec sidekiq -c 5
+  clock :  ./clock
+not a type: ./nothing
+: ./anonymous
+`
+	if err := os.WriteFile(filepath.Join(buildDir, "Procfile"), []byte(procfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	processes, err := ReadProcfile(buildDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"web":    "./server --port $PORT",
+		"worker": "bundle exec sidekiq -c 5",
+		"clock":  "./clock",
+	}
+	if !reflect.DeepEqual(processes, want) {
+		t.Errorf("got processes %v, want %v", processes, want)
+	}
+}
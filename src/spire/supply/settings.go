@@ -0,0 +1,411 @@
+package supply
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sourceDefault        = "default"
+	sourceBuildpackYml   = "buildpack.yml"
+	sourceEnv            = "env"
+	sourceServiceBinding = "service binding"
+)
+
+// ServerAddressEnv is the environment variable of the spire server address setting.
+const ServerAddressEnv = "SPIRE_SERVER_ADDRESS"
+
+// Settings declares every knob of the buildpack once. The struct tags of each field
+// name its default value, its environment variable, its path in buildpack.yml and the
+// service binding credential it is taken from. A `secret` tag redacts the value in logs.
+//
+// Values are resolved in the following order, each source overriding the previous ones:
+//
+//  1. the `default` tag
+//  2. the `yml` path in the app's buildpack.yml
+//  3. the `env` environment variable
+//  4. the `vcap` credential of the spire service binding in VCAP_SERVICES
+//
+// The map settings of the environment use the `key=value` syntax; in buildpack.yml they
+// are mappings of scalars. The egress hosts, tcp tunnels and destinations are mappings of
+// structured entries in buildpack.yml, see EgressHostConfig, TCPTunnelConfig and
+// DestinationConfig, so only their variables are here.
+type Settings struct {
+	ServerAddress           string            `env:"SPIRE_SERVER_ADDRESS" yml:"spire-agent.server_address" vcap:"spire.host"`
+	ServerPort              int               `env:"SPIRE_SERVER_PORT" yml:"spire-agent.server_port" vcap:"spire.port" default:"0"`
+	TrustDomain             string            `env:"SPIRE_TRUST_DOMAIN" yml:"spire-agent.trust_domain" vcap:"trust_domain"`
+	LogLevel                string            `env:"SPIRE_LOG_LEVEL" yml:"spire-agent.log_level" default:"INFO"`
+	SvidKeyType             string            `env:"SPIRE_AGENT_WORKLOAD_X509_SVID_KEY_TYPE" yml:"spire-agent.svid_key_type" default:"ec-p256"`
+	SpiffeID                string            `env:"SPIRE_APPLICATION_SPIFFE_ID" yml:"spire-agent.spiffe_id" vcap:"workload.spiffeID"`
+	SVIDStore               bool              `env:"SPIRE_CLOUDFOUNDRY_SVID_STORE" yml:"spire-agent.svid_store" default:"false"`
+	EnvoyProxy              bool              `env:"SPIRE_ENVOY_PROXY" yml:"envoy.enabled" default:"false"`
+	EnvoyLogLevel           string            `env:"SPIRE_ENVOY_LOG_LEVEL" yml:"envoy.log_level" default:"info"`
+	EnvoyComponentLogLevel  string            `env:"SPIRE_ENVOY_COMPONENT_LOG_LEVEL" yml:"envoy.component_log_level"`
+	EnvoyAppPort            int               `env:"SPIRE_ENVOY_APP_PORT" yml:"envoy.app_port" default:"8080"`
+	EnvoyListenerAddress    string            `env:"SPIRE_ENVOY_LISTENER_ADDRESS" yml:"envoy.listener_address" default:"0.0.0.0"`
+	EnvoyListenerPort       int               `env:"SPIRE_ENVOY_LISTENER_PORT" yml:"envoy.listener_port" default:"8000"`
+	EnvoyConnectionLimit    int               `env:"SPIRE_ENVOY_CONNECTION_LIMIT" yml:"envoy.connection_limit" default:"10000"`
+	EnvoyMaxConnections     int               `env:"SPIRE_ENVOY_GLOBAL_DOWNSTREAM_MAX_CONNECTIONS" yml:"envoy.global_downstream_max_connections" default:"50000"`
+	EnvoyDNSLookupFamily    string            `env:"SPIRE_ENVOY_DNS_LOOKUP_FAMILY" yml:"envoy.dns_lookup_family" default:"V4_ONLY"`
+	EnvoyIdleTimeout        time.Duration     `env:"SPIRE_ENVOY_IDLE_TIMEOUT" yml:"envoy.idle_timeout" default:"1s"`
+	EnvoyConnectTimeout     time.Duration     `env:"SPIRE_ENVOY_CONNECT_TIMEOUT" yml:"envoy.connect_timeout" default:"250ms"`
+	EnvoyRequestTimeout     time.Duration     `env:"SPIRE_ENVOY_REQUEST_TIMEOUT" yml:"envoy.request_timeout"`
+	EnvoyRetryOn            []string          `env:"SPIRE_ENVOY_RETRY_ON" yml:"envoy.retry_on"`
+	EnvoyMaxRetries         int               `env:"SPIRE_ENVOY_MAX_RETRIES" yml:"envoy.max_retries"`
+	EnvoyCBMaxConnections   int               `env:"SPIRE_ENVOY_CIRCUIT_BREAKER_MAX_CONNECTIONS" yml:"envoy.circuit_breakers.max_connections"`
+	EnvoyCBMaxPending       int               `env:"SPIRE_ENVOY_CIRCUIT_BREAKER_MAX_PENDING_REQUESTS" yml:"envoy.circuit_breakers.max_pending_requests"`
+	EnvoyCBMaxRequests      int               `env:"SPIRE_ENVOY_CIRCUIT_BREAKER_MAX_REQUESTS" yml:"envoy.circuit_breakers.max_requests"`
+	EnvoyDestinations       map[string]string `env:"SPIRE_ENVOY_DESTINATIONS"`
+	EnvoyUpstreams          map[string]string `env:"SPIRE_ENVOY_UPSTREAMS" yml:"envoy.upstreams"`
+	EnvoyEgress             map[string]string `env:"SPIRE_ENVOY_EGRESS"`
+	EnvoyEgressDefault      string            `env:"SPIRE_ENVOY_EGRESS_DEFAULT" yml:"envoy.egress.default" default:"deny"`
+	EnvoyTCPTunnels         map[string]string `env:"SPIRE_ENVOY_TCP_TUNNELS"`
+	EnvoyTCPTunnelAddress   string            `env:"SPIRE_ENVOY_TCP_TUNNEL_ADDRESS" yml:"envoy.tcp_tunnel_address" default:"127.0.0.1"`
+	EnvoyAdmin              bool              `env:"SPIRE_ENVOY_ADMIN" yml:"envoy.admin.enabled" default:"false"`
+	EnvoyAdminAddress       string            `env:"SPIRE_ENVOY_ADMIN_ADDRESS" yml:"envoy.admin.address" default:"127.0.0.1"`
+	EnvoyAdminPort          int               `env:"SPIRE_ENVOY_ADMIN_PORT" yml:"envoy.admin.port" default:"9901"`
+	EnvoyPrometheusAddress  string            `env:"SPIRE_ENVOY_TELEMETRY_PROMETHEUS_ADDRESS" yml:"envoy.telemetry.prometheus_address" default:"0.0.0.0"`
+	EnvoyPrometheusPort     int               `env:"SPIRE_ENVOY_TELEMETRY_PROMETHEUS_PORT" yml:"envoy.telemetry.prometheus_port" default:"0"`
+	EnvoyStatsdAddresses    []string          `env:"SPIRE_ENVOY_TELEMETRY_STATSD_ADDRESSES" yml:"envoy.telemetry.statsd_addresses"`
+	EnvoyDogStatsdAddresses []string          `env:"SPIRE_ENVOY_TELEMETRY_DOGSTATSD_ADDRESSES" yml:"envoy.telemetry.dogstatsd_addresses"`
+	EnvoyIngress            bool              `env:"SPIRE_ENVOY_INGRESS" yml:"envoy.ingress.enabled" default:"false"`
+	EnvoyIngressAddress     string            `env:"SPIRE_ENVOY_INGRESS_ADDRESS" yml:"envoy.ingress.address" default:"0.0.0.0"`
+	EnvoyIngressPort        int               `env:"SPIRE_ENVOY_INGRESS_PORT" yml:"envoy.ingress.port" default:"8443"`
+	EnvoyIngressIDHeader    string            `env:"SPIRE_ENVOY_INGRESS_IDENTITY_HEADER" yml:"envoy.ingress.identity_header" default:"xfcc"`
+	EnvoyIngressAllowedIDs  []string          `env:"SPIRE_ENVOY_INGRESS_ALLOWED_SPIFFE_IDS" yml:"envoy.ingress.allowed_spiffe_ids"`
+	EnvoyIngressAllowedPath []string          `env:"SPIRE_ENVOY_INGRESS_ALLOWED_PATH_PREFIXES" yml:"envoy.ingress.allowed_path_prefixes"`
+	TrustBundle             string            `env:"SPIRE_TRUST_BUNDLE" vcap:"trust_bundle"`
+	TrustBundleFile         string            `yml:"spire-agent.trust_bundle_file"`
+	TrustBundleURL          string            `env:"SPIRE_TRUST_BUNDLE_URL" yml:"spire-agent.trust_bundle_url" vcap:"trust_bundle_url"`
+	TrustBundleFormat       string            `env:"SPIRE_TRUST_BUNDLE_FORMAT" yml:"spire-agent.trust_bundle_format" vcap:"trust_bundle_format" default:"pem"`
+	TrustBundleURLCheck     bool              `env:"SPIRE_TRUST_BUNDLE_URL_CHECK" yml:"spire-agent.trust_bundle_url_check" default:"false"`
+	KeyManager              string            `env:"SPIRE_AGENT_KEY_MANAGER" yml:"spire-agent.key_manager" default:"memory"`
+	DataDirRoot             string            `env:"SPIRE_AGENT_DATA_DIR_ROOT" yml:"spire-agent.data_dir_root" default:"deps"`
+	DataDir                 string            `env:"SPIRE_AGENT_DATA_DIR" yml:"spire-agent.data_dir" default:"spire-agent-data"`
+	NodeAttestor            string            `env:"SPIRE_NODE_ATTESTOR" yml:"spire-agent.node_attestor.type" default:"cf_iic"`
+	NodeAttestorKeyPath     string            `env:"SPIRE_NODE_ATTESTOR_PRIVATE_KEY_PATH" yml:"spire-agent.node_attestor.private_key_path" default:"/etc/cf-instance-credentials/instance.key"`
+	NodeAttestorCertPath    string            `env:"SPIRE_NODE_ATTESTOR_CERTIFICATE_PATH" yml:"spire-agent.node_attestor.certificate_path" default:"/etc/cf-instance-credentials/instance.crt"`
+	NodeAttestorChainPath   string            `env:"SPIRE_NODE_ATTESTOR_INTERMEDIATES_PATH" yml:"spire-agent.node_attestor.intermediates_path"`
+	JoinToken               string            `env:"SPIRE_JOIN_TOKEN" vcap:"join_token" secret:"true"`
+	AgentPrometheusHost     string            `env:"SPIRE_AGENT_TELEMETRY_PROMETHEUS_HOST" yml:"spire-agent.telemetry.prometheus_host" default:"localhost"`
+	AgentPrometheusPort     int               `env:"SPIRE_AGENT_TELEMETRY_PROMETHEUS_PORT" yml:"spire-agent.telemetry.prometheus_port" default:"0"`
+	AgentDogStatsdAddresses []string          `env:"SPIRE_AGENT_TELEMETRY_DOGSTATSD_ADDRESSES" yml:"spire-agent.telemetry.dogstatsd_addresses"`
+	AgentStatsdAddresses    []string          `env:"SPIRE_AGENT_TELEMETRY_STATSD_ADDRESSES" yml:"spire-agent.telemetry.statsd_addresses"`
+	SidecarFor              []string          `env:"SPIRE_SIDECAR_FOR" yml:"sidecars.sidecar_for" default:"web"`
+	AgentSidecarFor         []string          `env:"SPIRE_AGENT_SIDECAR_FOR" yml:"sidecars.spire_agent.sidecar_for"`
+	AgentSidecarMemory      int               `env:"SPIRE_AGENT_SIDECAR_MEMORY" yml:"sidecars.spire_agent.memory" default:"0"`
+	EnvoySidecarFor         []string          `env:"SPIRE_ENVOY_SIDECAR_FOR" yml:"sidecars.envoy.sidecar_for"`
+	EnvoySidecarMemory      int               `env:"SPIRE_ENVOY_SIDECAR_MEMORY" yml:"sidecars.envoy.memory" default:"0"`
+	SVIDStoreSidecarFor     []string          `env:"SPIRE_SVID_STORE_SIDECAR_FOR" yml:"sidecars.svid_store.sidecar_for"`
+	SVIDStoreSidecarMemory  int               `env:"SPIRE_SVID_STORE_SIDECAR_MEMORY" yml:"sidecars.svid_store.memory" default:"0"`
+	UpdaterSidecarFor       []string          `env:"SPIRE_CONFIG_UPDATER_SIDECAR_FOR" yml:"sidecars.config_updater.sidecar_for"`
+	UpdaterSidecarMemory    int               `env:"SPIRE_CONFIG_UPDATER_SIDECAR_MEMORY" yml:"sidecars.config_updater.memory" default:"0"`
+	ServiceName             string            `env:"SPIRE_SERVICE_NAME" yml:"spire-agent.service.name"`
+	ServiceLabel            string            `env:"SPIRE_SERVICE_LABEL" yml:"spire-agent.service.label"`
+	ServiceTag              string            `env:"SPIRE_SERVICE_TAG" yml:"spire-agent.service.tag"`
+}
+
+// ResolvedSetting describes where the effective value of a setting came from.
+type ResolvedSetting struct {
+	Name   string
+	Value  string
+	Source string
+	Secret bool
+}
+
+func (r ResolvedSetting) String() string {
+	value := r.Value
+	if r.Secret && value != "" {
+		value = "[REDACTED]"
+	}
+	return fmt.Sprintf("%s=%q (%s)", r.Name, value, r.Source)
+}
+
+var vcapSources = map[string]func(*Credentials) string{
+	"spire.host": func(c *Credentials) string {
+		if c.Spire == nil {
+			return ""
+		}
+		return c.Spire.Host
+	},
+	"spire.port": func(c *Credentials) string {
+		if c.Spire == nil || c.Spire.Port == 0 {
+			return ""
+		}
+		return strconv.Itoa(int(c.Spire.Port))
+	},
+	"trust_domain": func(c *Credentials) string {
+		return c.SpireTrustDomain()
+	},
+	"trust_bundle": func(c *Credentials) string {
+		return c.TrustBundle
+	},
+	"trust_bundle_url": func(c *Credentials) string {
+		return c.TrustBundleURL
+	},
+	"trust_bundle_format": func(c *Credentials) string {
+		return c.TrustBundleFormat
+	},
+	"join_token": func(c *Credentials) string {
+		return c.JoinToken
+	},
+	"workload.spiffeID": func(c *Credentials) string {
+		if c.Workload == nil {
+			return ""
+		}
+		return c.Workload.SpiffeID
+	},
+}
+
+// ResolveSettings builds the effective settings out of the buildpack.yml values, the
+// environment and the service binding credentials, which may be nil.
+func ResolveSettings(config map[string]interface{}, creds *Credentials) (Settings, []ResolvedSetting, error) {
+	var settings Settings
+	var resolved []ResolvedSetting
+
+	v := reflect.ValueOf(&settings).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		value, source, err := resolveValue(field, config, creds)
+		if err != nil {
+			return Settings{}, nil, fmt.Errorf("invalid value for %s in %s: %v", settingLabel(field, source), source, err)
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return Settings{}, nil, fmt.Errorf("invalid value for %s from %s: %v", settingLabel(field, source), source, err)
+		}
+
+		resolved = append(resolved, ResolvedSetting{
+			Name:   settingName(field),
+			Value:  value,
+			Source: source,
+			Secret: field.Tag.Get("secret") == "true",
+		})
+	}
+
+	return settings, resolved, nil
+}
+
+// settingName names the setting by its environment variable, or else by its path in
+// buildpack.yml.
+func settingName(field reflect.StructField) string {
+	if env := field.Tag.Get("env"); env != "" {
+		return env
+	}
+	if path := field.Tag.Get("yml"); path != "" {
+		return path
+	}
+	return field.Name
+}
+
+// settingLabel names the setting the way the source its value came from does, such as
+// the buildpack.yml path for a value of buildpack.yml.
+func settingLabel(field reflect.StructField, source string) string {
+	var label string
+	switch source {
+	case sourceBuildpackYml:
+		label = field.Tag.Get("yml")
+	case sourceEnv:
+		label = field.Tag.Get("env")
+	case sourceServiceBinding:
+		label = field.Tag.Get("vcap")
+	}
+	if label == "" {
+		return settingName(field)
+	}
+	return label
+}
+
+// resolveValue returns the effective raw value of the setting field and its source. It
+// fails when the buildpack.yml value has a shape the setting can't take.
+func resolveValue(field reflect.StructField, config map[string]interface{}, creds *Credentials) (string, string, error) {
+	value, source := field.Tag.Get("default"), sourceDefault
+	if path := field.Tag.Get("yml"); path != "" {
+		ymlValue, ok, err := lookupYml(config, path)
+		if err != nil {
+			return "", sourceBuildpackYml, err
+		}
+		if ok {
+			value, source = ymlValue, sourceBuildpackYml
+		}
+	}
+	if env := field.Tag.Get("env"); env != "" {
+		if envValue := utils.EnvWithDefault(env, ""); envValue != "" {
+			value, source = envValue, sourceEnv
+		}
+	}
+	if vcap := field.Tag.Get("vcap"); vcap != "" && creds != nil {
+		if vcapValue := vcapSources[vcap](creds); vcapValue != "" {
+			value, source = vcapValue, sourceServiceBinding
+		}
+	}
+	return value, source, nil
+}
+
+// ResolveBindingSelector resolves the settings selecting the spire service binding
+// alone: the binding is selected before the other settings, which it provides values
+// for, are resolved.
+func ResolveBindingSelector(config map[string]interface{}) BindingSelector {
+	t := reflect.TypeOf(Settings{})
+	value := func(name string) string {
+		field, _ := t.FieldByName(name)
+		v, _, _ := resolveValue(field, config, nil)
+		return v
+	}
+
+	return BindingSelector{
+		Name:  value("ServiceName"),
+		Label: value("ServiceLabel"),
+		Tag:   value("ServiceTag"),
+	}
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int64:
+		if field.Type() != reflect.TypeOf(time.Duration(0)) {
+			return fmt.Errorf("unsupported setting type %s", field.Type())
+		}
+		if value == "" {
+			field.SetInt(0)
+			return nil
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case reflect.Int:
+		if value == "" {
+			field.SetInt(0)
+			return nil
+		}
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Bool:
+		if value == "" {
+			field.SetBool(false)
+			return nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", field.Type())
+		}
+		items := map[string]string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, v, found := strings.Cut(item, "=")
+			if !found {
+				return fmt.Errorf("`%s` is not a key=value pair", item)
+			}
+			items[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported setting type %s", field.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Kind())
+	}
+	return nil
+}
+
+// lookupYml walks a dotted path such as `spire-agent.server_address` through the
+// decoded buildpack.yml and returns the value in the form the setting takes in the
+// environment. Lists and maps must hold scalars.
+func lookupYml(config map[string]interface{}, path string) (string, bool, error) {
+	current, ok := lookupYmlValue(config, path)
+	if !ok {
+		return "", false, nil
+	}
+
+	switch value := current.(type) {
+	case map[string]interface{}:
+		s, err := joinYmlMap(value)
+		return s, err == nil, err
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[fmt.Sprint(k)] = v
+		}
+		s, err := joinYmlMap(m)
+		return s, err == nil, err
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			if !isYmlScalar(item) {
+				return "", false, fmt.Errorf("the list must only hold scalars")
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), true, nil
+	}
+	return fmt.Sprint(current), true, nil
+}
+
+// lookupYmlValue returns the decoded buildpack.yml value at the dotted path.
+func lookupYmlValue(config map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = config
+	for _, key := range strings.Split(path, ".") {
+		switch m := current.(type) {
+		case map[string]interface{}:
+			current = m[key]
+		case map[interface{}]interface{}:
+			current = m[key]
+		default:
+			return nil, false
+		}
+		if current == nil {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// joinYmlMap joins a map of scalars into sorted `key=value` pairs, the form the map
+// settings take in the environment.
+func joinYmlMap(m map[string]interface{}) (string, error) {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		if !isYmlScalar(v) {
+			return "", fmt.Errorf("the value of `%s` must be a scalar", k)
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ","), nil
+}
+
+func isYmlScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
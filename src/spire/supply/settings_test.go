@@ -0,0 +1,218 @@
+package supply
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveSettingsPrecedence(t *testing.T) {
+	config := map[string]interface{}{
+		"spire-agent": map[interface{}]interface{}{
+			"server_port": 8082,
+			"spiffe_id":   "spiffe://example.org/app",
+		},
+	}
+	creds := &Credentials{Spire: &Spire{Host: "spire.example.org", Port: 8084}}
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		env    string
+		creds  *Credentials
+		port   int
+		source string
+	}{
+		{name: "default", config: map[string]interface{}{}, port: 0, source: sourceDefault},
+		{name: "buildpack.yml", config: config, port: 8082, source: sourceBuildpackYml},
+		{name: "env", config: config, env: "8083", port: 8083, source: sourceEnv},
+		{name: "service binding", config: config, env: "8083", creds: creds, port: 8084, source: sourceServiceBinding},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SPIRE_SERVER_PORT", test.env)
+
+			settings, resolved, err := ResolveSettings(test.config, test.creds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if settings.ServerPort != test.port {
+				t.Errorf("got server port %d, want %d", settings.ServerPort, test.port)
+			}
+			for _, r := range resolved {
+				if r.Name == "SPIRE_SERVER_PORT" && r.Source != test.source {
+					t.Errorf("got source %q, want %q", r.Source, test.source)
+				}
+			}
+		})
+	}
+
+	t.Setenv("SPIRE_APPLICATION_SPIFFE_ID", "")
+	settings, _, err := ResolveSettings(config, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.SpiffeID != "spiffe://example.org/app" {
+		t.Errorf("a binding without the setting overrode buildpack.yml: got %q", settings.SpiffeID)
+	}
+}
+
+func TestSettingLabel(t *testing.T) {
+	settings := reflect.TypeOf(Settings{})
+	field := func(name string) reflect.StructField {
+		f, ok := settings.FieldByName(name)
+		if !ok {
+			t.Fatalf("no setting %s", name)
+		}
+		return f
+	}
+
+	tests := []struct {
+		field    string
+		source   string
+		expected string
+	}{
+		{field: "ServerPort", source: sourceBuildpackYml, expected: "spire-agent.server_port"},
+		{field: "ServerPort", source: sourceEnv, expected: "SPIRE_SERVER_PORT"},
+		{field: "ServerPort", source: sourceServiceBinding, expected: "spire.port"},
+		{field: "ServerPort", source: sourceDefault, expected: "SPIRE_SERVER_PORT"},
+		{field: "EnvoyEgress", source: sourceBuildpackYml, expected: "SPIRE_ENVOY_EGRESS"},
+		{field: "TrustBundleFile", source: sourceEnv, expected: "spire-agent.trust_bundle_file"},
+	}
+
+	for _, test := range tests {
+		if label := settingLabel(field(test.field), test.source); label != test.expected {
+			t.Errorf("got label %q for %s from %s, want %q", label, test.field, test.source, test.expected)
+		}
+	}
+}
+
+func TestResolvedSettingRedactsSecrets(t *testing.T) {
+	secret := ResolvedSetting{Name: "SPIRE_JOIN_TOKEN", Value: "s3cr3t-token", Source: sourceEnv, Secret: true}
+	if s := secret.String(); strings.Contains(s, "s3cr3t-token") || !strings.Contains(s, "[REDACTED]") {
+		t.Errorf("secret isn't redacted: %s", s)
+	}
+
+	public := ResolvedSetting{Name: "SPIRE_TRUST_DOMAIN", Value: "example.org", Source: sourceEnv}
+	if s := public.String(); !strings.Contains(s, "example.org") {
+		t.Errorf("public setting is redacted: %s", s)
+	}
+
+	empty := ResolvedSetting{Name: "SPIRE_JOIN_TOKEN", Source: sourceDefault, Secret: true}
+	if s := empty.String(); strings.Contains(s, "REDACTED") {
+		t.Errorf("an empty secret shouldn't be redacted: %s", s)
+	}
+}
+
+func TestResolveSettingsMap(t *testing.T) {
+	config := map[string]interface{}{
+		"envoy": map[interface{}]interface{}{
+			"upstreams": map[interface{}]interface{}{
+				"api.example.org": "spiffe://example.org/api",
+				"*.example.com":   "example.com",
+			},
+		},
+	}
+
+	settings, _, err := ResolveSettings(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"api.example.org": "spiffe://example.org/api",
+		"*.example.com":   "example.com",
+	}
+	if !reflect.DeepEqual(settings.EnvoyUpstreams, want) {
+		t.Errorf("got %v, want %v", settings.EnvoyUpstreams, want)
+	}
+
+	t.Setenv("SPIRE_ENVOY_UPSTREAMS", "db.example.org = example.org")
+	settings, _, err = ResolveSettings(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"db.example.org": "example.org"}; !reflect.DeepEqual(settings.EnvoyUpstreams, want) {
+		t.Errorf("env didn't override buildpack.yml: got %v", settings.EnvoyUpstreams)
+	}
+
+	t.Setenv("SPIRE_ENVOY_UPSTREAMS", "db.example.org")
+	if _, _, err := ResolveSettings(config, nil); err == nil {
+		t.Error("expected an error for a value without =")
+	}
+}
+
+func TestResolveSettingsEgressDefault(t *testing.T) {
+	config := map[string]interface{}{
+		"envoy": map[interface{}]interface{}{
+			"egress": map[interface{}]interface{}{
+				"hosts":   map[interface{}]interface{}{"api.github.com": "tls"},
+				"default": "tls",
+			},
+		},
+	}
+
+	settings, _, err := ResolveSettings(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.EnvoyEgressDefault != "tls" {
+		t.Errorf("got default egress %q, want tls", settings.EnvoyEgressDefault)
+	}
+	if len(settings.EnvoyEgress) != 0 {
+		t.Errorf("egress hosts of buildpack.yml were read as a setting: %v", settings.EnvoyEgress)
+	}
+}
+
+func TestResolveSettingsNestedYml(t *testing.T) {
+	config := map[string]interface{}{
+		"envoy": map[interface{}]interface{}{
+			"upstreams": map[interface{}]interface{}{
+				"api.example.org": map[interface{}]interface{}{"spiffe_id": "spiffe://example.org/api"},
+			},
+		},
+	}
+	if _, _, err := ResolveSettings(config, nil); err == nil || !strings.Contains(err.Error(), "envoy.upstreams") {
+		t.Errorf("expected an error for a nested map, got %v", err)
+	}
+
+	config = map[string]interface{}{
+		"sidecars": map[interface{}]interface{}{
+			"envoy": map[interface{}]interface{}{
+				"sidecar_for": []interface{}{"web", []interface{}{"worker"}},
+			},
+		},
+	}
+	if _, _, err := ResolveSettings(config, nil); err == nil || !strings.Contains(err.Error(), "sidecars.envoy.sidecar_for") {
+		t.Errorf("expected an error for a nested list, got %v", err)
+	}
+}
+
+func TestResolveSettingsResiliency(t *testing.T) {
+	settings, _, err := ResolveSettings(map[string]interface{}{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.EnvoyConnectTimeout != 250*time.Millisecond {
+		t.Errorf("got connect timeout %s, want 250ms", settings.EnvoyConnectTimeout)
+	}
+
+	t.Setenv("SPIRE_ENVOY_CONNECT_TIMEOUT", "2s")
+	t.Setenv("SPIRE_ENVOY_RETRY_ON", "5xx,reset")
+	t.Setenv("SPIRE_ENVOY_DESTINATIONS", "api.example.org=request_timeout=30s;retry_on=reset|connect-failure")
+	settings, _, err = ResolveSettings(map[string]interface{}{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.EnvoyConnectTimeout != 2*time.Second {
+		t.Errorf("got connect timeout %s, want 2s", settings.EnvoyConnectTimeout)
+	}
+	if want := []string{"5xx", "reset"}; !reflect.DeepEqual(settings.EnvoyRetryOn, want) {
+		t.Errorf("got retry on %v, want %v", settings.EnvoyRetryOn, want)
+	}
+	want := map[string]string{"api.example.org": "request_timeout=30s;retry_on=reset|connect-failure"}
+	if !reflect.DeepEqual(settings.EnvoyDestinations, want) {
+		t.Errorf("got destinations %v, want %v", settings.EnvoyDestinations, want)
+	}
+}
@@ -0,0 +1,155 @@
+// Package spiffeid parses and validates SPIFFE IDs according to the SPIFFE ID
+// specification: https://github.com/spiffe/spiffe/blob/main/standards/SPIFFE-ID.md
+package spiffeid
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	scheme = "spiffe://"
+
+	maxIDLength          = 2048
+	maxTrustDomainLength = 255
+)
+
+var (
+	errEmpty                = errors.New("cannot be empty")
+	errTooLong              = errors.New("longer than 2048 bytes")
+	errWrongScheme          = errors.New("scheme is missing or invalid")
+	errMissingTrustDomain   = errors.New("trust domain is missing")
+	errTrustDomainTooLong   = errors.New("trust domain is longer than 255 bytes")
+	errBadTrustDomainChar   = errors.New("trust domain characters are limited to lowercase letters, numbers, dots, dashes, and underscores")
+	errBadPathSegmentChar   = errors.New("path segment characters are limited to letters, numbers, dots, dashes, and underscores")
+	errDotSegment           = errors.New("path cannot contain dot segments")
+	errEmptySegment         = errors.New("path cannot contain empty segments")
+	errTrailingSlash        = errors.New("path cannot have a trailing slash")
+	errNoLeadingSlash       = errors.New("path must have a leading slash")
+	errQueryOrFragment      = errors.New("query and fragment are not allowed")
+	errUserInfoOrPortNumber = errors.New("trust domain cannot contain user info or a port")
+)
+
+// ID is a parsed and validated SPIFFE ID.
+type ID struct {
+	trustDomain string
+	path        string
+}
+
+// FromString parses a SPIFFE ID such as `spiffe://example.org/app/web`.
+func FromString(s string) (ID, error) {
+	switch {
+	case s == "":
+		return ID{}, errEmpty
+	case len(s) > maxIDLength:
+		return ID{}, errTooLong
+	case !strings.HasPrefix(s, scheme):
+		return ID{}, errWrongScheme
+	}
+
+	rest := s[len(scheme):]
+	if strings.ContainsAny(rest, "?#") {
+		return ID{}, errQueryOrFragment
+	}
+
+	td, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		td, path = rest[:i], rest[i:]
+	}
+
+	if err := ValidateTrustDomain(td); err != nil {
+		return ID{}, err
+	}
+	if err := ValidatePath(path); err != nil {
+		return ID{}, err
+	}
+
+	return ID{trustDomain: td, path: path}, nil
+}
+
+// ValidateTrustDomain checks the trust domain name of a SPIFFE ID, e.g. `example.org`.
+func ValidateTrustDomain(td string) error {
+	switch {
+	case td == "":
+		return errMissingTrustDomain
+	case len(td) > maxTrustDomainLength:
+		return errTrustDomainTooLong
+	case strings.ContainsAny(td, "@:"):
+		return errUserInfoOrPortNumber
+	}
+
+	for i := 0; i < len(td); i++ {
+		if !isTrustDomainChar(td[i]) {
+			return errBadTrustDomainChar
+		}
+	}
+	return nil
+}
+
+// ValidatePath checks the path of a SPIFFE ID, e.g. `/app/web`. The empty path is valid.
+func ValidatePath(path string) error {
+	if path == "" {
+		return nil
+	}
+	if path[0] != '/' {
+		return errNoLeadingSlash
+	}
+	if path == "/" {
+		return errTrailingSlash
+	}
+
+	segments := strings.Split(path[1:], "/")
+	for i, segment := range segments {
+		switch segment {
+		case "":
+			if i == len(segments)-1 {
+				return errTrailingSlash
+			}
+			return errEmptySegment
+		case ".", "..":
+			return errDotSegment
+		}
+
+		for j := 0; j < len(segment); j++ {
+			if !isPathSegmentChar(segment[j]) {
+				return errBadPathSegmentChar
+			}
+		}
+	}
+	return nil
+}
+
+// TrustDomain returns the trust domain name, e.g. `example.org`.
+func (id ID) TrustDomain() string {
+	return id.trustDomain
+}
+
+// Path returns the path, e.g. `/app/web`, or an empty string.
+func (id ID) Path() string {
+	return id.path
+}
+
+// MemberOf reports whether the ID belongs to the given trust domain name.
+func (id ID) MemberOf(td string) bool {
+	return !id.IsZero() && id.trustDomain == td
+}
+
+// IsZero reports whether the ID is the zero value.
+func (id ID) IsZero() bool {
+	return id.trustDomain == ""
+}
+
+func (id ID) String() string {
+	if id.IsZero() {
+		return ""
+	}
+	return scheme + id.trustDomain + id.path
+}
+
+func isTrustDomainChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_'
+}
+
+func isPathSegmentChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '-' || c == '_'
+}
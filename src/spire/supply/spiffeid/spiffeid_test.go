@@ -0,0 +1,115 @@
+package spiffeid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFromString(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		trustDomain string
+		path        string
+		err         error
+	}{
+		{name: "trust domain only", id: "spiffe://example.org", trustDomain: "example.org"},
+		{name: "single segment", id: "spiffe://example.org/web", trustDomain: "example.org", path: "/web"},
+		{name: "multiple segments", id: "spiffe://example.org/ns/prod/sa/web", trustDomain: "example.org", path: "/ns/prod/sa/web"},
+		{name: "allowed trust domain characters", id: "spiffe://a-b_c.0-9", trustDomain: "a-b_c.0-9"},
+		{name: "allowed path characters", id: "spiffe://example.org/AZaz09.-_", trustDomain: "example.org", path: "/AZaz09.-_"},
+		{name: "segment with dots", id: "spiffe://example.org/...", trustDomain: "example.org", path: "/..."},
+		{name: "empty", id: "", err: errEmpty},
+		{name: "missing scheme", id: "example.org/web", err: errWrongScheme},
+		{name: "wrong scheme", id: "https://example.org/web", err: errWrongScheme},
+		{name: "uppercase scheme", id: "SPIFFE://example.org/web", err: errWrongScheme},
+		{name: "missing trust domain", id: "spiffe:///web", err: errMissingTrustDomain},
+		{name: "scheme only", id: "spiffe://", err: errMissingTrustDomain},
+		{name: "uppercase trust domain", id: "spiffe://Example.org/web", err: errBadTrustDomainChar},
+		{name: "bad trust domain character", id: "spiffe://exa$mple.org", err: errBadTrustDomainChar},
+		{name: "port", id: "spiffe://example.org:8080/web", err: errUserInfoOrPortNumber},
+		{name: "user info", id: "spiffe://user@example.org/web", err: errUserInfoOrPortNumber},
+		{name: "trailing slash", id: "spiffe://example.org/", err: errTrailingSlash},
+		{name: "trailing slash after segment", id: "spiffe://example.org/web/", err: errTrailingSlash},
+		{name: "empty segment", id: "spiffe://example.org//web", err: errEmptySegment},
+		{name: "dot segment", id: "spiffe://example.org/./web", err: errDotSegment},
+		{name: "dot dot segment", id: "spiffe://example.org/web/..", err: errDotSegment},
+		{name: "bad path character", id: "spiffe://example.org/we%20b", err: errBadPathSegmentChar},
+		{name: "query", id: "spiffe://example.org/web?x=1", err: errQueryOrFragment},
+		{name: "fragment", id: "spiffe://example.org/web#x", err: errQueryOrFragment},
+		{name: "trust domain too long", id: "spiffe://" + strings.Repeat("a", 256), err: errTrustDomainTooLong},
+		{name: "trust domain at max length", id: "spiffe://" + strings.Repeat("a", 255), trustDomain: strings.Repeat("a", 255)},
+		{name: "too long", id: "spiffe://example.org/" + strings.Repeat("a", 2048), err: errTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := FromString(tt.id)
+			if err != tt.err {
+				t.Fatalf("error = %v, expected %v", err, tt.err)
+			}
+			if err != nil {
+				if !id.IsZero() {
+					t.Errorf("expected zero ID on error, got %q", id)
+				}
+				return
+			}
+			if id.TrustDomain() != tt.trustDomain {
+				t.Errorf("trust domain = %q, expected %q", id.TrustDomain(), tt.trustDomain)
+			}
+			if id.Path() != tt.path {
+				t.Errorf("path = %q, expected %q", id.Path(), tt.path)
+			}
+			if id.String() != tt.id {
+				t.Errorf("string = %q, expected %q", id.String(), tt.id)
+			}
+		})
+	}
+}
+
+func TestMemberOf(t *testing.T) {
+	id, err := FromString("spiffe://example.org/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		trustDomain string
+		expected    bool
+	}{
+		{trustDomain: "example.org", expected: true},
+		{trustDomain: "other.org", expected: false},
+		{trustDomain: "example.org.evil", expected: false},
+		{trustDomain: "", expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := id.MemberOf(tt.trustDomain); got != tt.expected {
+			t.Errorf("MemberOf(%q) = %v, expected %v", tt.trustDomain, got, tt.expected)
+		}
+	}
+
+	if (ID{}).MemberOf("") {
+		t.Error("zero ID must not be a member of any trust domain")
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	tests := []struct {
+		path string
+		err  error
+	}{
+		{path: ""},
+		{path: "/web"},
+		{path: "web", err: errNoLeadingSlash},
+		{path: "/", err: errTrailingSlash},
+		{path: "/web//api", err: errEmptySegment},
+		{path: "/web/../api", err: errDotSegment},
+	}
+
+	for _, tt := range tests {
+		if err := ValidatePath(tt.path); err != tt.err {
+			t.Errorf("ValidatePath(%q) = %v, expected %v", tt.path, err, tt.err)
+		}
+	}
+}
@@ -3,27 +3,12 @@ package supply
 import (
 	"fmt"
 	"github.com/cloudfoundry/libbuildpack"
-	"github.com/nnicora/spire-agent-sidecar-buildpack/src/utils"
-	"html/template"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/envoy"
 	"io"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
-)
-
-const (
-	spireServerAddressEnv          = "SPIRE_SERVER_ADDRESS"
-	spireServerPortEnv             = "SPIRE_SERVER_PORT"
-	spireTrustDomainEnv            = "SPIRE_TRUST_DOMAIN"
-	spireLogLevelEnv               = "SPIRE_LOG_LEVEL"
-	spireEnvoyProxyEnv             = "SPIRE_ENVOY_PROXY"
-	spireApplicationSpiffeIdEnv    = "SPIRE_APPLICATION_SPIFFE_ID"
-	spireCloudFoundrySVIDStoreEnv  = "SPIRE_CLOUDFOUNDRY_SVID_STORE"
-	spireEnvoyLogLevelEnv          = "SPIRE_ENVOY_LOG_LEVEL"
-	spireEnvoyComponentLogLevelEnv = "SPIRE_ENVOY_COMPONENT_LOG_LEVEL"
-	svidKeyTypeEnv                 = "SPIRE_AGENT_WORKLOAD_X509_SVID_KEY_TYPE"
 )
 
 var (
@@ -61,12 +46,14 @@ type Stager interface {
 }
 
 type Config struct {
-	SpireAgent SpireAgentConfig `yaml:"spire-agent"`
-	Dist       string           `yaml:"dist"`
+	SpireAgent   SpireAgentConfig `yaml:"spire-agent"`
+	Dist         string           `yaml:"dist"`
+	StartCommand string           `yaml:"start_command"`
 }
 
 type SpireAgentConfig struct {
-	Version string `yaml:"version"`
+	Version string         `yaml:"version"`
+	Plugins []PluginConfig `yaml:"plugins"`
 }
 
 type Supplier struct {
@@ -75,6 +62,9 @@ type Supplier struct {
 	Installer    Installer
 	Log          *libbuildpack.Logger
 	Config       Config
+	ConfigValues map[string]interface{}
+	Credentials  *Credentials
+	Settings     Settings
 	Command      Command
 	VersionLines map[string]string
 }
@@ -92,232 +82,125 @@ func New(stager Stager, manifest Manifest, installer Installer, logger *libbuild
 func (s *Supplier) Run() error {
 	s.Log.BeginStep("Supplying spire")
 
-	creds := s.ExtractSpireCredentialsFromVcapServices()
-
-	if err := s.Copy("certificates", "certificates"); err != nil {
-		s.Log.Error("Failed to copy certificates; %s", err.Error())
+	if err := s.Setup(); err != nil {
+		s.Log.Error("Could not setup; %s", err.Error())
 		return err
 	}
 
-	if err := s.CopySpireAgentConf(creds); err != nil {
-		s.Log.Error("Failed to configure spire-agent.conf file; %s", err.Error())
+	if err := s.Validate(); err != nil {
 		return err
 	}
 
-	if err := s.Copy("bin", "binaries"); err != nil {
-		s.Log.Error("Failed to copy binaries; %s", err.Error())
+	if err := s.CopySpireAgentConf(); err != nil {
+		s.Log.Error("Failed to configure spire-agent.conf file; %s", err.Error())
 		return err
 	}
 
-	if err := s.CreateLaunchForSidecars(creds); err != nil {
-		s.Log.Error("Failed to create the sidecar processes; %s", err.Error())
+	if err := s.InstallDependencies(s.Credentials); err != nil {
+		s.Log.Error("Failed to install dependencies; %s", err.Error())
 		return err
 	}
 
-	if err := s.Setup(); err != nil {
-		s.Log.Error("Could not setup; %s", err.Error())
+	if err := s.CreateLaunchForSidecars(s.Credentials); err != nil {
+		s.Log.Error("Failed to create the sidecar processes; %s", err.Error())
 		return err
 	}
 
 	return nil
 }
 
-func (s *Supplier) Copy(dst string, srcs ...string) error {
-	paths := make([]string, 0, len(srcs)+1)
-	paths = append(paths, s.Manifest.RootDir())
-
-	for _, location := range srcs {
-		paths = append(paths, location)
-	}
-
-	dir := filepath.Join(paths...)
-
-	err := filepath.Walk(dir, func(srcPath string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			return nil
-		}
-		if err != nil {
-			s.Log.Error("Can't copy file: %s", err.Error())
+func (s *Supplier) CreateLaunchForSidecars(creds *Credentials) error {
+	if s.Settings.EnvoyProxy {
+		if err := s.WriteEnvoyConfig(); err != nil {
 			return err
 		}
-		dstPath := filepath.Join(s.Stager.DepDir(), dst, info.Name())
-		if errCopy := libbuildpack.CopyFile(srcPath, dstPath); errCopy != nil {
-			s.Log.Error("Can't copy file: %s; Source `%s`, destination `%s`", errCopy.Error(), srcPath, dstPath)
-			return errCopy
-		} else {
-			s.Log.Info("Copy file from Source `%s`, destination `%s`", srcPath, dstPath)
-		}
-
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 
-	return nil
+	return s.Launch(creds).Write(filepath.Join(s.Stager.DepDir(), "launch.yml"))
 }
 
-func (s *Supplier) CreateLaunchForSidecars(creds *Credentials) error {
-	launch := filepath.Join(s.Stager.DepDir(), "launch.yml")
-	if _, err := libbuildpack.FileExists(launch); err != nil {
-		return err
-	}
-
-	launchFile, err := os.Create(launch)
-	if err != nil {
-		return err
-	}
-
-	_, err = launchFile.WriteString("---\nprocesses:\n")
-	if err != nil {
-		return err
-	}
+// Launch returns the sidecar processes run next to the application.
+func (s *Supplier) Launch(creds *Credentials) *Launch {
+	depDir := filepath.Join("/home/vcap/deps", s.Stager.DepsIdx())
 
-	spireAgentSidecarTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "spire_agent-sidecar.tmpl")
-	spireAgentSidecar := template.Must(template.ParseFiles(spireAgentSidecarTmpl))
-	err = spireAgentSidecar.Execute(launchFile, map[string]interface{}{
-		"Idx": s.Stager.DepsIdx(),
-	})
-	if err != nil {
-		return err
-	}
+	launch := &Launch{}
+	launch.Add(s.sidecar(spireAgentProcess,
+		fmt.Sprintf("%s/bin/spire-agent run -config %s/spire-agent.conf", depDir, depDir)))
 
-	envoyProxy := utils.EnvWithDefault(spireEnvoyProxyEnv, "false")
-	if strings.ToLower(envoyProxy) == "true" {
-		envoyConfig := filepath.Join(s.Stager.DepDir(), "envoy-config.yaml")
-		if _, err := libbuildpack.FileExists(launch); err != nil {
-			return err
+	if s.Settings.EnvoyProxy {
+		bootstrap := filepath.Join(depDir, "envoy-config.yaml")
+		command := fmt.Sprintf("/etc/cf-assets/envoy/envoy -c %s --base-id %d --log-level %s",
+			bootstrap, rand.Int63n(65000), s.Settings.EnvoyLogLevel)
+		if s.Settings.EnvoyComponentLogLevel != "" {
+			command += " " + s.Settings.EnvoyComponentLogLevel
 		}
-
-		envoyConfigFile, err := os.Create(envoyConfig)
-		if err != nil {
-			return err
+		if s.Settings.EnvoyIngress {
+			// The ingress forwards to the $PORT of the app, only known at launch.
+			command = envoy.AppPortRewrite(bootstrap) + " && " + command
 		}
+		launch.Add(s.sidecar(envoyProxyProcess, command))
+	}
 
-		envoyProxyConfigTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "custom-envoy-conf.tmpl")
-		envoyProxyConfig := template.Must(template.ParseFiles(envoyProxyConfigTmpl))
-
-		sasid := utils.EnvWithDefault(spireApplicationSpiffeIdEnv, "SpiffeID")
-
-		if creds != nil && creds.Workload != nil {
-			sasid = creds.Workload.SpiffeID
-		}
+	if s.Settings.SVIDStore {
+		launch.Add(s.sidecar(svidFileProcess, fmt.Sprintf("mkdir -p /tmp/spire-agent/certificates && "+
+			"while (true); do echo 'Refresh SVID'; %s/bin/spire-agent api fetch x509 -socketPath /tmp/spire-agent/public/api.sock -write /tmp/spire-agent/certificates; sleep 10; done",
+			depDir)))
+	}
 
-		err = envoyProxyConfig.Execute(envoyConfigFile, map[string]interface{}{
-			"Idx":      s.Stager.DepsIdx(),
-			"SpiffeID": sasid,
-		})
-		if err != nil {
-			return err
-		}
+	if creds == nil {
+		launch.Add(s.sidecar(configUpdaterProcess,
+			fmt.Sprintf("%s/bin/config-updater -spire-agent-config %s/spire-agent.conf -envoy-config %s/envoy-config.yaml -sync-interval 1",
+				depDir, depDir, depDir)))
+	}
 
-		err = envoyConfigFile.Close()
-		if err != nil {
-			return err
-		}
+	return launch
+}
 
-		ll := utils.EnvWithDefault(spireEnvoyLogLevelEnv, "info")
-		cll := utils.EnvWithDefault(spireEnvoyComponentLogLevelEnv, "")
-
-		envoyProxySidecarTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "envoy_proxy-sidecar.tmpl")
-		envoyProxySidecar := template.Must(template.ParseFiles(envoyProxySidecarTmpl))
-		err = envoyProxySidecar.Execute(launchFile, map[string]interface{}{
-			"Idx":               s.Stager.DepsIdx(),
-			"BaseId":            rand.Int63n(65000),
-			"LogLevel":          ll,
-			"ComponentLogLevel": cll,
-		})
-		if err != nil {
-			return err
-		}
-	}
+// UsesConfigUpdater reports whether the config-updater sidecar provides the spire
+// settings at runtime, which it does when no spire service is bound at staging.
+func (s *Supplier) UsesConfigUpdater() bool {
+	return s.Credentials == nil
+}
 
-	svidFile := utils.EnvWithDefault(spireCloudFoundrySVIDStoreEnv, "false")
-	if strings.ToLower(svidFile) == "true" {
-		svidFileSidecarTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "svid-file-sidecar.tmpl")
-		svidFileSidecar := template.Must(template.ParseFiles(svidFileSidecarTmpl))
-		err = svidFileSidecar.Execute(launchFile, map[string]interface{}{
-			"Idx": s.Stager.DepsIdx(),
-		})
-		if err != nil {
-			return err
-		}
-	}
+func (s *Supplier) CopySpireAgentConf() error {
+	conf := filepath.Join(s.Stager.DepDir(), "spire-agent.conf")
+	s.Log.Info("Spire agent conf: %s", conf)
 
-	if creds == nil {
-		configUpdatersSidecarTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "config-updaters.tmpl")
-		configUpdaterSidecar := template.Must(template.ParseFiles(configUpdatersSidecarTmpl))
-		err = configUpdaterSidecar.Execute(launchFile, map[string]interface{}{
-			"Idx": s.Stager.DepsIdx(),
-		})
+	trustBundlePath := ""
+	if !s.UsesTrustBundleURL() {
+		var err error
+		trustBundlePath, err = s.WriteTrustBundle()
 		if err != nil {
 			return err
 		}
 	}
 
-	err = launchFile.Close()
+	config, err := s.AgentConfig(trustBundlePath)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return os.WriteFile(conf, config.HCL(), 0644)
 }
 
-func (s *Supplier) CopySpireAgentConf(creds *Credentials) error {
-	conf := filepath.Join(s.Stager.DepDir(), "spire-agent.conf")
-	if _, err := libbuildpack.FileExists(conf); err != nil {
-		return err
-	}
-
-	f, err := os.Create(conf)
+// ResolveSettings resolves the effective settings and logs them.
+func (s *Supplier) ResolveSettings(creds *Credentials) error {
+	settings, resolved, err := ResolveSettings(s.ConfigValues, creds)
 	if err != nil {
 		return err
 	}
 
-	s.Log.Info("Spire agent conf: %s", conf)
-
-	confTmpl := filepath.Join(s.Manifest.RootDir(), "templates", "spire-agent-conf.tmpl")
-	t := template.Must(template.ParseFiles(confTmpl))
-
-	ssa := utils.EnvWithDefault(spireServerAddressEnv, "")
-	ssp := utils.EnvWithDefault(spireServerPortEnv, "0")
-	std := utils.EnvWithDefault(spireTrustDomainEnv, "")
-	skt := utils.EnvWithDefault(svidKeyTypeEnv, defaultSvidKeyType)
-	if _, ok := allowedSvidKeyTypes[skt]; !ok {
-		skt = defaultSvidKeyType
-	}
-
-	if creds != nil && creds.Spire != nil {
-		ssa = creds.Spire.Host
-		ssp = fmt.Sprintf("%d", creds.Spire.Port)
-		std = creds.SpireTrustDomain()
-	}
-
-	ll := utils.EnvWithDefault(spireLogLevelEnv, "INFO")
-
-	data := map[string]interface{}{
-		"Idx":                s.Stager.DepsIdx(),
-		"SpireServerAddress": ssa,
-		"SpireServerPort":    ssp,
-		"TrustDomain":        std,
-		"SvidKeyType":        skt,
-		"LogLevel":           ll,
+	if _, ok := allowedSvidKeyTypes[settings.SvidKeyType]; !ok {
+		s.Log.Warning("Unsupported SVID key type `%s`; using `%s`", settings.SvidKeyType, defaultSvidKeyType)
+		settings.SvidKeyType = defaultSvidKeyType
 	}
 
-	cfSvidStoreEnv := utils.EnvWithDefault(spireCloudFoundrySVIDStoreEnv, "false")
-	if strings.ToLower(cfSvidStoreEnv) == "true" {
-		data["CloudFoundrySVIDStoreEnabled"] = true
-	}
-	err = t.Execute(f, data)
-	if err != nil {
-		return err
-	}
-
-	err = f.Close()
-	if err != nil {
-		return err
+	s.Log.Info("Effective settings:")
+	for _, r := range resolved {
+		s.Log.Info("  %s", r)
 	}
 
+	s.Settings = settings
 	return nil
 }
 
@@ -329,15 +212,30 @@ func (s *Supplier) Setup() error {
 		if err := libbuildpack.NewYAML().Load(configPath, &s.Config); err != nil {
 			return err
 		}
+		if err := libbuildpack.NewYAML().Load(configPath, &s.ConfigValues); err != nil {
+			return err
+		}
 	}
 
-	var m struct {
-		VersionLines map[string]string `yaml:"version_lines"`
-	}
-	if err := libbuildpack.NewYAML().Load(filepath.Join(s.Manifest.RootDir(), "manifest.yml"), &m); err != nil {
+	versionLines, err := LoadVersionLines(s.Manifest.RootDir())
+	if err != nil {
 		return err
 	}
-	s.VersionLines = m.VersionLines
+	s.VersionLines = versionLines
+
+	creds, err := s.ExtractSpireCredentialsFromVcapServices()
+	if err != nil {
+		return fmt.Errorf("failed to select the spire service binding: %v", err)
+	}
+	s.Credentials = creds
+
+	if err := s.ResolveSettings(creds); err != nil {
+		return fmt.Errorf("invalid settings: %v", err)
+	}
+
+	if err := s.SetupDataDir(); err != nil {
+		return fmt.Errorf("could not create the agent data directory: %v", err)
+	}
 
 	// create logs directory in case if doesn't exist
 	logsDirPath := filepath.Join(s.Stager.BuildDir(), "logs")
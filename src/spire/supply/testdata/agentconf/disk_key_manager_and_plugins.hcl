@@ -0,0 +1,53 @@
+agent {
+  server_address = "spire.example.org"
+  server_port = 8081
+  log_level = "INFO"
+  trust_domain = "example.org"
+  data_dir = "/home/vcap/deps/0/spire-agent-data"
+  trust_bundle_path = "/home/vcap/deps/0/certificates/trust-bundle.crt"
+  workload_x509_svid_key_type = "ec-p256"
+}
+
+plugins {
+  KeyManager "disk" {
+    plugin_data {
+      directory = "/home/vcap/deps/0/spire-agent-data"
+    }
+  }
+
+  NodeAttestor "cf_iic" {
+    plugin_cmd = "/home/vcap/deps/0/bin/cf_iic"
+    plugin_data {
+      certificate_path = "/etc/cf-instance-credentials/instance.crt"
+      private_key_path = "/etc/cf-instance-credentials/instance.key"
+    }
+  }
+
+  WorkloadAttestor "unix" {
+    plugin_data {
+      discover_workload_path = true
+      workload_size_limit = 0
+    }
+  }
+
+  SVIDStore "cf" {
+    plugin_cmd = "/home/vcap/deps/0/bin/svidstore_file"
+    plugin_data {
+      write_path = "/tmp/spire-agent"
+    }
+  }
+
+  WorkloadAttestor "custom" {
+    plugin_cmd = "/home/vcap/app/plugins/custom"
+    plugin_checksum = "7c2b7f60030eede8c6587bb72d0ddf90ae0069620c6042add5fd17ad35be367a"
+    plugin_data {
+      enabled = true
+      labels = ["a", "b"]
+      limit = 1024
+      nested {
+        key = "value"
+      }
+      ratio = 0.5
+    }
+  }
+}
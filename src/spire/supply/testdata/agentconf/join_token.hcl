@@ -0,0 +1,27 @@
+agent {
+  server_address = "spire.example.org"
+  server_port = 8081
+  log_level = "INFO"
+  trust_domain = "example.org"
+  data_dir = "/home/vcap/deps/0/spire-agent-data"
+  join_token = "0f2a8e1c-7d3b-4e6a-8f9c-1b2d3e4f5a6b"
+  trust_bundle_path = "/home/vcap/deps/0/certificates/trust-bundle.crt"
+  workload_x509_svid_key_type = "ec-p256"
+}
+
+plugins {
+  KeyManager "memory" {
+    plugin_data {
+    }
+  }
+
+  NodeAttestor "join_token" {
+    plugin_data {
+    }
+  }
+
+  WorkloadAttestor "unix" {
+    plugin_data {
+    }
+  }
+}
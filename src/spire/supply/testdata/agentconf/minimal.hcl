@@ -0,0 +1,29 @@
+agent {
+  server_address = "spire.example.org"
+  server_port = 8081
+  log_level = "INFO"
+  trust_domain = "example.org"
+  data_dir = "/home/vcap/deps/0/spire-agent-data"
+  trust_bundle_path = "/home/vcap/deps/0/certificates/trust-bundle.crt"
+  workload_x509_svid_key_type = "ec-p256"
+}
+
+plugins {
+  KeyManager "memory" {
+    plugin_data {
+    }
+  }
+
+  NodeAttestor "cf_iic" {
+    plugin_cmd = "/home/vcap/deps/0/bin/cf_iic"
+    plugin_data {
+      certificate_path = "/etc/cf-instance-credentials/instance.crt"
+      private_key_path = "/etc/cf-instance-credentials/instance.key"
+    }
+  }
+
+  WorkloadAttestor "unix" {
+    plugin_data {
+    }
+  }
+}
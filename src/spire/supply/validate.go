@@ -0,0 +1,131 @@
+package supply
+
+import (
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply/spiffeid"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?))*$`)
+)
+
+// ValidationError holds every problem found in the settings at staging time.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid spire configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the resolved settings and the files the agent needs at runtime, so
+// that a broken configuration fails the staging instead of the spire-agent sidecar.
+//
+// Without a spire service binding the config-updater sidecar provides the server, the
+// trust domain and the SPIFFE ID at runtime, so they are only checked when they are set.
+func (s *Supplier) Validate() error {
+	verr := &ValidationError{}
+	updater := s.UsesConfigUpdater()
+	if updater {
+		s.Log.Info("No spire service binding; the config-updater sidecar provides the unset spire settings at runtime")
+	}
+
+	if s.Settings.ServerAddress == "" {
+		if !updater {
+			verr.add("spire server address is not set; bind a spire service or set SPIRE_SERVER_ADDRESS")
+		}
+	} else if !isValidHost(s.Settings.ServerAddress) {
+		verr.add("spire server address `%s` is neither a valid hostname nor an IP address", s.Settings.ServerAddress)
+	}
+
+	if port := s.Settings.ServerPort; (port != 0 || !updater) && (port < 1 || port > 65535) {
+		verr.add("spire server port %d is out of range 1-65535; bind a spire service or set SPIRE_SERVER_PORT", port)
+	}
+
+	if s.Settings.TrustDomain == "" {
+		if !updater {
+			verr.add("trust domain is not set; bind a spire service or set SPIRE_TRUST_DOMAIN")
+		}
+	} else if err := spiffeid.ValidateTrustDomain(s.Settings.TrustDomain); err != nil {
+		verr.add("trust domain `%s` is invalid: %v", s.Settings.TrustDomain, err)
+	}
+
+	if s.Settings.SpiffeID != "" {
+		if err := validateSpiffeID(s.Settings.SpiffeID, s.Settings.TrustDomain); err != nil {
+			verr.add("SPIFFE ID `%s` is invalid: %v", s.Settings.SpiffeID, err)
+		}
+	} else if s.Settings.EnvoyProxy && !updater {
+		verr.add("SPIFFE ID is required by the envoy proxy; bind a spire service or set SPIRE_APPLICATION_SPIFFE_ID")
+	}
+
+	if s.UsesTrustBundleURL() {
+		if err := ValidateTrustBundleURL(s.Settings.TrustBundleURL, s.Settings.TrustBundleFormat); err != nil {
+			verr.add("trust bundle URL `%s` is invalid: %v", s.Settings.TrustBundleURL, err)
+		} else if s.Settings.TrustBundleURLCheck {
+			if _, err := FetchTrustBundle(s.Settings.TrustBundleURL, s.Settings.TrustBundleFormat); err != nil {
+				verr.add("can't fetch trust bundle from `%s`: %v", s.Settings.TrustBundleURL, err)
+			}
+		}
+		if s.Settings.TrustBundle != "" || s.Settings.TrustBundleFile != "" {
+			s.Log.Warning("Trust bundle URL is set; ignoring the local trust bundle")
+		}
+	} else if bundle, source, err := s.TrustBundle(); err != nil {
+		verr.add("can't load trust bundle: %v", err)
+	} else if _, err := ParseTrustBundle(bundle); err != nil {
+		verr.add("trust bundle from %s is invalid: %v", source, err)
+	}
+
+	if s.Settings.EnvoyProxy {
+		verr.Problems = append(verr.Problems, s.ValidateEnvoy()...)
+	} else if s.Settings.EnvoyIngress {
+		verr.add("envoy ingress requires the envoy proxy; set SPIRE_ENVOY_PROXY")
+	}
+
+	if s.Settings.KeyManager != keyManagerMemory && s.Settings.KeyManager != keyManagerDisk {
+		verr.add("unsupported KeyManager `%s`; use `%s` or `%s`", s.Settings.KeyManager, keyManagerMemory, keyManagerDisk)
+	}
+
+	verr.Problems = append(verr.Problems, s.ValidateNodeAttestor()...)
+	verr.Problems = append(verr.Problems, s.ValidateDependencies()...)
+	verr.Problems = append(verr.Problems, s.ValidateSidecars()...)
+
+	if plugins, err := s.AgentPlugins(); err != nil {
+		verr.add("%v", err)
+	} else {
+		verr.Problems = append(verr.Problems, s.ValidatePluginBinaries(plugins)...)
+	}
+
+	if len(verr.Problems) > 0 {
+		for _, problem := range verr.Problems {
+			s.Log.Error("%s", problem)
+		}
+		return verr
+	}
+
+	return nil
+}
+
+func isValidHost(host string) bool {
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return true
+	}
+	return len(host) <= 253 && hostnameRegexp.MatchString(host)
+}
+
+func validateSpiffeID(s, td string) error {
+	id, err := spiffeid.FromString(s)
+	if err != nil {
+		return err
+	}
+	if td != "" && !id.MemberOf(td) {
+		return fmt.Errorf("does not belong to trust domain `%s`", td)
+	}
+	return nil
+}
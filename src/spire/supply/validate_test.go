@@ -0,0 +1,132 @@
+package supply
+
+import (
+	"errors"
+	"github.com/cloudfoundry/libbuildpack"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeStager struct {
+	Stager
+	buildDir string
+	depDir   string
+}
+
+func (f fakeStager) BuildDir() string { return f.buildDir }
+func (f fakeStager) DepDir() string   { return f.depDir }
+func (f fakeStager) DepsIdx() string  { return "0" }
+
+type fakeManifest struct {
+	Manifest
+	rootDir  string
+	versions map[string][]string
+}
+
+func (f fakeManifest) RootDir() string                            { return f.rootDir }
+func (f fakeManifest) AllDependencyVersions(name string) []string { return f.versions[name] }
+
+func validationSupplier(t *testing.T, settings Settings) *Supplier {
+	t.Helper()
+
+	rootDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootDir, "certificates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootDir, "certificates", "bundle.crt"), testPEM(t, "ca", true), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings.KeyManager, settings.DataDirRoot, settings.DataDir = keyManagerMemory, dataDirRootDeps, "spire-agent-data"
+	settings.NodeAttestor, settings.JoinToken = nodeAttestorJoinToken, "2c7e2d04-1c8a-4f3c-9c2b-3c1b5c6d7e8f"
+	manifest := fakeManifest{rootDir: rootDir, versions: map[string][]string{
+		spireAgentDependency:    {"1.6.3"},
+		configUpdaterDependency: {"1.0.0"},
+	}}
+	return &Supplier{
+		Stager:      fakeStager{buildDir: t.TempDir(), depDir: t.TempDir()},
+		Manifest:    manifest,
+		Log:         libbuildpack.NewLogger(io.Discard),
+		Credentials: &Credentials{},
+		Settings:    settings,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Settings{
+		ServerAddress: "spire.example.org",
+		ServerPort:    8081,
+		TrustDomain:   "example.org",
+		SpiffeID:      "spiffe://example.org/app",
+	}
+	if err := validationSupplier(t, valid).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		settings Settings
+		problems []string
+	}{
+		{
+			name:     "nothing set",
+			settings: Settings{EnvoyProxy: true},
+			problems: []string{"server address is not set", "server port 0", "trust domain is not set", "SPIFFE ID is required", "envoy trust domain ``", "SPIFFE ID of the proxy is not set"},
+		},
+		{
+			name:     "invalid values",
+			settings: Settings{ServerAddress: "not a host", ServerPort: 65536, TrustDomain: "Example.org", SpiffeID: "spiffe://other.org/app"},
+			problems: []string{"server address `not a host`", "server port 65536", "trust domain `Example.org`", "SPIFFE ID `spiffe://other.org/app`"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var verr *ValidationError
+			if err := validationSupplier(t, test.settings).Validate(); !errors.As(err, &verr) {
+				t.Fatalf("expected a validation error, got %v", err)
+			}
+			if len(verr.Problems) != len(test.problems) {
+				t.Errorf("got problems %q, want %d", verr.Problems, len(test.problems))
+			}
+			for _, want := range test.problems {
+				if !containsProblem(verr.Problems, want) {
+					t.Errorf("expected a problem containing `%s`, got %q", want, verr.Problems)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateWithConfigUpdater(t *testing.T) {
+	s := validationSupplier(t, Settings{EnvoyProxy: true})
+	s.Credentials = nil
+
+	if err := s.Validate(); err != nil {
+		t.Errorf("expected the settings provided by the config-updater to be skipped, got %v", err)
+	}
+
+	s.Settings.ServerAddress = "not a host"
+	s.Settings.TrustDomain = "Example.org"
+	var verr *ValidationError
+	if err := s.Validate(); !errors.As(err, &verr) {
+		t.Fatalf("expected the set values to be checked, got %v", err)
+	}
+	for _, want := range []string{"server address `not a host`", "trust domain `Example.org`"} {
+		if !containsProblem(verr.Problems, want) {
+			t.Errorf("expected a problem containing `%s`, got %q", want, verr.Problems)
+		}
+	}
+}
+
+// containsProblem reports whether one of the problems contains want.
+func containsProblem(problems []string, want string) bool {
+	for _, p := range problems {
+		if strings.Contains(p, want) {
+			return true
+		}
+	}
+	return false
+}
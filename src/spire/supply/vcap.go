@@ -2,12 +2,18 @@ package supply
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/nnicora/spire-agent-sidecar-buildpack/src/spire/supply/spiffeid"
+	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 const (
-	vcapEnv = "VCAP_SERVICES"
+	// VcapServicesEnv holds the service bindings of the app.
+	VcapServicesEnv = "VCAP_SERVICES"
 )
 
 type Instance struct {
@@ -18,40 +24,295 @@ type Instance struct {
 	Label        string       `json:"label"`
 	Name         string       `json:"name"`
 	Plan         string       `json:"plan"`
+	Tags         []string     `json:"tags"`
 	Credentials  *Credentials `json:"credentials"`
+
+	// credentialsErr is the error of decoding credentials which have a spire shape. It
+	// is only reported when the binding is selected, so that a broken binding doesn't
+	// fail the apps which use another one.
+	credentialsErr error
+}
+
+// HasSpireCredentials reports whether the binding carries the spire server details and
+// either the workload SPIFFE ID or the trust domain.
+func (i *Instance) HasSpireCredentials() bool {
+	return i.Credentials != nil && i.Credentials.Spire != nil &&
+		(i.Credentials.Workload != nil || i.Credentials.TrustDomain != "")
+}
+
+// isSpireBinding reports whether the binding has spire credentials, including ones which
+// failed to decode.
+func (i *Instance) isSpireBinding() bool {
+	return i.credentialsErr != nil || i.HasSpireCredentials()
+}
+
+func (i *Instance) hasTag(tag string) bool {
+	for _, t := range i.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// BindingSelector narrows down the spire service bindings; empty fields match any binding.
+type BindingSelector struct {
+	Name  string
+	Label string
+	Tag   string
 }
 
+func (b BindingSelector) IsSet() bool {
+	return b.Name != "" || b.Label != "" || b.Tag != ""
+}
+
+func (b BindingSelector) Matches(i *Instance) bool {
+	if b.Name != "" && b.Name != i.Name && b.Name != i.InstanceName && b.Name != i.BindingName {
+		return false
+	}
+	if b.Label != "" && b.Label != i.Label {
+		return false
+	}
+	if b.Tag != "" && !i.hasTag(b.Tag) {
+		return false
+	}
+	return true
+}
+
+// Credentials is the normalized form of the spire service binding credentials. Bindings
+// may use any of the shapes known to the registered CredentialsDecoders.
 type Credentials struct {
-	Spire    *Spire    `json:"spire"`
-	Workload *Workload `json:"workload"`
+	Spire             *Spire    `json:"spire"`
+	Workload          *Workload `json:"workload"`
+	TrustDomain       string    `json:"trust_domain,omitempty"`
+	TrustBundle       string    `json:"trust_bundle,omitempty"`
+	TrustBundleURL    string    `json:"trust_bundle_url,omitempty"`
+	TrustBundleFormat string    `json:"trust_bundle_format,omitempty"`
+	JoinToken         string    `json:"join_token,omitempty"`
 }
 
 type Spire struct {
 	Host string `json:"host"`
-	Port int    `json:"port"`
+	Port Port   `json:"port"`
+}
+
+// Port is a port number which may be given either as a JSON number or as a string.
+type Port int
+
+func (p *Port) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*p = Port(n)
+		return nil
+	}
+
+	var v string
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("port must be a number or a string, got %s", data)
+	}
+	if strings.TrimSpace(v) == "" {
+		*p = 0
+		return nil
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return fmt.Errorf("invalid port `%s`", v)
+	}
+	*p = Port(n)
+	return nil
+}
+
+// CredentialsDecoder turns the raw credentials of a service binding into Credentials.
+// Decode returns nil when the credentials don't have the decoder's shape, and an error
+// when they have its shape but a value is invalid.
+type CredentialsDecoder interface {
+	Decode(raw json.RawMessage) (*Credentials, error)
+}
+
+type CredentialsDecoderFunc func(raw json.RawMessage) (*Credentials, error)
+
+func (f CredentialsDecoderFunc) Decode(raw json.RawMessage) (*Credentials, error) {
+	return f(raw)
+}
+
+var credentialsDecoders = []CredentialsDecoder{
+	CredentialsDecoderFunc(decodeNestedCredentials),
+	CredentialsDecoderFunc(decodeFlatCredentials),
+}
+
+// RegisterCredentialsDecoder adds a decoder which is tried after the built-in ones.
+func RegisterCredentialsDecoder(d CredentialsDecoder) {
+	credentialsDecoders = append(credentialsDecoders, d)
 }
 
+// UnmarshalJSON uses the first decoder which recognizes the credentials. Credentials
+// of other services, which no decoder recognizes, are left empty.
+func (s *Credentials) UnmarshalJSON(data []byte) error {
+	*s = Credentials{}
+	for _, d := range credentialsDecoders {
+		creds, err := d.Decode(data)
+		if err != nil {
+			return err
+		}
+		if creds != nil {
+			*s = *creds
+			return nil
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON keeps the errors of the credentials on the instance, naming the binding.
+func (i *Instance) UnmarshalJSON(data []byte) error {
+	type instance Instance
+	var v struct {
+		instance
+		Credentials json.RawMessage `json:"credentials"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*i = Instance(v.instance)
+	if len(v.Credentials) == 0 || string(v.Credentials) == "null" {
+		return nil
+	}
+	i.Credentials = &Credentials{}
+	if err := json.Unmarshal(v.Credentials, i.Credentials); err != nil {
+		i.Credentials = nil
+		i.credentialsErr = fmt.Errorf("credentials of service binding `%s` are invalid: %v", i.Name, err)
+	}
+	return nil
+}
+
+// decodeNestedCredentials decodes
+//
+//	{"spire": {"host": "...", "port": 8081}, "workload": {"spiffeID": "..."}, "trust_bundle": "..."}
+//
+// The bundle may also be given as `trust_bundle_url` and `trust_bundle_format`, and a
+// `join_token` may be given for join token node attestation.
+func decodeNestedCredentials(raw json.RawMessage) (*Credentials, error) {
+	var shape struct {
+		Spire *struct {
+			Host string `json:"host"`
+		} `json:"spire"`
+	}
+	if err := json.Unmarshal(raw, &shape); err != nil || shape.Spire == nil || shape.Spire.Host == "" {
+		return nil, nil
+	}
+
+	var v struct {
+		Spire             *Spire    `json:"spire"`
+		Workload          *Workload `json:"workload"`
+		TrustDomain       string    `json:"trust_domain"`
+		TrustBundle       string    `json:"trust_bundle"`
+		TrustBundleURL    string    `json:"trust_bundle_url"`
+		TrustBundleFormat string    `json:"trust_bundle_format"`
+		JoinToken         string    `json:"join_token"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	if v.Workload != nil && v.Workload.SpiffeID == "" {
+		v.Workload = nil
+	}
+
+	return &Credentials{
+		Spire:             v.Spire,
+		Workload:          v.Workload,
+		TrustDomain:       v.TrustDomain,
+		TrustBundle:       v.TrustBundle,
+		TrustBundleURL:    v.TrustBundleURL,
+		TrustBundleFormat: v.TrustBundleFormat,
+		JoinToken:         v.JoinToken,
+	}, nil
+}
+
+// decodeFlatCredentials decodes
+//
+//	{"server_address": "host[:port]", "server_port": "8081", "trust_domain": "...", "spiffe_id": "...", "trust_bundle": "..."}
+//
+// The bundle may also be given as `trust_bundle_url` and `trust_bundle_format`, and a
+// `join_token` may be given for join token node attestation. A `server_address` is common
+// to other services, so the shape also needs the trust domain or the SPIFFE ID.
+func decodeFlatCredentials(raw json.RawMessage) (*Credentials, error) {
+	var shape struct {
+		ServerAddress string `json:"server_address"`
+		TrustDomain   string `json:"trust_domain"`
+		SpiffeID      string `json:"spiffe_id"`
+	}
+	if err := json.Unmarshal(raw, &shape); err != nil || shape.ServerAddress == "" ||
+		(shape.TrustDomain == "" && shape.SpiffeID == "") {
+		return nil, nil
+	}
+
+	var v struct {
+		ServerAddress     string `json:"server_address"`
+		ServerPort        Port   `json:"server_port"`
+		TrustDomain       string `json:"trust_domain"`
+		SpiffeID          string `json:"spiffe_id"`
+		TrustBundle       string `json:"trust_bundle"`
+		TrustBundleURL    string `json:"trust_bundle_url"`
+		TrustBundleFormat string `json:"trust_bundle_format"`
+		JoinToken         string `json:"join_token"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+
+	spire := &Spire{Host: v.ServerAddress, Port: v.ServerPort}
+	if host, port, err := net.SplitHostPort(v.ServerAddress); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port `%s` in server address `%s`", port, v.ServerAddress)
+		}
+		spire.Host = host
+		if spire.Port == 0 {
+			spire.Port = Port(p)
+		}
+	}
+
+	creds := &Credentials{
+		Spire:             spire,
+		TrustDomain:       v.TrustDomain,
+		TrustBundle:       v.TrustBundle,
+		TrustBundleURL:    v.TrustBundleURL,
+		TrustBundleFormat: v.TrustBundleFormat,
+		JoinToken:         v.JoinToken,
+	}
+	if v.SpiffeID != "" {
+		creds.Workload = &Workload{SpiffeID: v.SpiffeID}
+	}
+	return creds, nil
+}
+
+// SpireTrustDomain returns the explicit trust domain of the credentials, or the trust
+// domain of the workload SPIFFE ID; it is empty when neither is available.
 func (s *Credentials) SpireTrustDomain() string {
-	spiffeID := s.Workload.SpiffeID
-	if strings.HasPrefix(spiffeID, "spiffe://") {
-		spiffeID = strings.TrimPrefix(spiffeID, "spiffe://")
-		return strings.Split(spiffeID, "/")[0]
+	if s.TrustDomain != "" {
+		return s.TrustDomain
+	}
+	if s.Workload == nil {
+		return ""
+	}
+	id, err := spiffeid.FromString(s.Workload.SpiffeID)
+	if err != nil {
+		return ""
 	}
-	return ""
+	return id.TrustDomain()
 }
 
 type Workload struct {
 	SpiffeID string `json:"spiffeID"`
 }
 
-func (s *Supplier) loadVCAP() (map[string][]*Instance, error) {
+// ParseVcapServices decodes the content of the VCAP_SERVICES environment variable.
+func ParseVcapServices(v string) (map[string][]*Instance, error) {
 	data := map[string][]*Instance{}
 
-	if v, ok := os.LookupEnv(vcapEnv); ok && v != "" {
-		s.Log.Info("%s founded; Load Spire Credentials out of it. Value: %s", vcapEnv, v)
-
-		err := json.Unmarshal([]byte(v), &data)
-		if err != nil {
+	if v != "" {
+		if err := json.Unmarshal([]byte(v), &data); err != nil {
 			return nil, err
 		}
 	}
@@ -59,20 +320,94 @@ func (s *Supplier) loadVCAP() (map[string][]*Instance, error) {
 	return data, nil
 }
 
-func (s *Supplier) ExtractSpireCredentialsFromVcapServices() *Credentials {
-	if d, err := s.loadVCAP(); err != nil {
-		s.Log.Info("Couldn't load %s environment variable: %v", vcapEnv, err)
-	} else {
-		for _, v := range d {
-			if len(v) > 0 {
-				for _, i := range v {
-					if i.Credentials != nil && i.Credentials.Spire != nil && i.Credentials.Workload != nil {
-						return i.Credentials
-					}
-				}
+// SpireBindings returns the bindings which carry spire credentials, valid or not, sorted by label
+// and name so that the result doesn't depend on the map iteration order.
+func SpireBindings(services map[string][]*Instance) []*Instance {
+	labels := make([]string, 0, len(services))
+	for label := range services {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var bindings []*Instance
+	for _, label := range labels {
+		instances := make([]*Instance, 0, len(services[label]))
+		for _, i := range services[label] {
+			if i != nil && i.isSpireBinding() {
+				instances = append(instances, i)
 			}
 		}
+		sort.SliceStable(instances, func(a, b int) bool {
+			return instances[a].Name < instances[b].Name
+		})
+		bindings = append(bindings, instances...)
+	}
+
+	return bindings
+}
+
+// SelectSpireBinding returns the single spire binding matching the selector, or nil when
+// there is no spire binding at all. It fails when the selector matches nothing, when
+// several bindings match, or when the credentials of the matching binding are invalid.
+func SelectSpireBinding(services map[string][]*Instance, selector BindingSelector) (*Instance, error) {
+	var matches []*Instance
+	for _, i := range SpireBindings(services) {
+		if selector.Matches(i) {
+			matches = append(matches, i)
+		}
+	}
+
+	switch {
+	case len(matches) == 1 && matches[0].credentialsErr != nil:
+		return nil, matches[0].credentialsErr
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) == 0 && selector.IsSet():
+		return nil, fmt.Errorf("no spire service binding matches name `%s`, label `%s` and tag `%s`",
+			selector.Name, selector.Label, selector.Tag)
+	case len(matches) == 0:
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(matches))
+	for _, i := range matches {
+		names = append(names, i.Name)
+	}
+	return nil, fmt.Errorf("found %d spire service bindings (%s); select one with SPIRE_SERVICE_NAME, SPIRE_SERVICE_LABEL or SPIRE_SERVICE_TAG",
+		len(matches), strings.Join(names, ", "))
+}
+
+// FindSpireCredentials returns the credentials of the first valid spire binding.
+func FindSpireCredentials(services map[string][]*Instance) *Credentials {
+	for _, b := range SpireBindings(services) {
+		if b.credentialsErr == nil {
+			return b.Credentials
+		}
 	}
 
 	return nil
 }
+
+func (s *Supplier) loadVCAP() (map[string][]*Instance, error) {
+	v, ok := os.LookupEnv(VcapServicesEnv)
+	if ok && v != "" {
+		s.Log.Info("%s founded; Load Spire Credentials out of it", VcapServicesEnv)
+	}
+
+	return ParseVcapServices(v)
+}
+
+func (s *Supplier) ExtractSpireCredentialsFromVcapServices() (*Credentials, error) {
+	d, err := s.loadVCAP()
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %v", VcapServicesEnv, err)
+	}
+
+	binding, err := SelectSpireBinding(d, ResolveBindingSelector(s.ConfigValues))
+	if err != nil || binding == nil {
+		return nil, err
+	}
+
+	s.Log.Info("Using spire service binding; instance `%s`, binding `%s`", binding.InstanceName, binding.BindingName)
+	return binding.Credentials, nil
+}
@@ -0,0 +1,276 @@
+package supply
+
+import (
+	"github.com/cloudfoundry/libbuildpack"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func loadVcapFixture(t *testing.T, name string) map[string][]*Instance {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "vcap", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := ParseVcapServices(string(data))
+	if err != nil {
+		t.Fatalf("can't parse %s: %v", name, err)
+	}
+	return services
+}
+
+func TestCredentialsShapes(t *testing.T) {
+	webID := &Workload{SpiffeID: "spiffe://example.org/app/web"}
+
+	tests := []struct {
+		fixture     string
+		expected    *Credentials
+		trustDomain string
+	}{
+		{
+			fixture:     "nested.json",
+			expected:    &Credentials{Spire: &Spire{Host: "spire.example.org", Port: 8081}, Workload: webID},
+			trustDomain: "example.org",
+		},
+		{
+			fixture:     "nested_string_port.json",
+			expected:    &Credentials{Spire: &Spire{Host: "spire.example.org", Port: 8081}, Workload: webID},
+			trustDomain: "example.org",
+		},
+		{
+			fixture:     "flat.json",
+			expected:    &Credentials{Spire: &Spire{Host: "spire.example.org", Port: 8081}, Workload: webID, TrustDomain: "example.org"},
+			trustDomain: "example.org",
+		},
+		{
+			fixture:     "flat_host_port.json",
+			expected:    &Credentials{Spire: &Spire{Host: "spire.example.org", Port: 8081}, TrustDomain: "example.org"},
+			trustDomain: "example.org",
+		},
+		{
+			fixture:     "user_provided.json",
+			expected:    &Credentials{Spire: &Spire{Host: "10.0.1.15", Port: 8081}, Workload: webID, TrustDomain: "example.org"},
+			trustDomain: "example.org",
+		},
+		{
+			fixture: "inline_bundle.json",
+			expected: &Credentials{
+				Spire:       &Spire{Host: "spire.example.org", Port: 8081},
+				Workload:    webID,
+				TrustBundle: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+			},
+			trustDomain: "example.org",
+		},
+		{
+			fixture:  "unrelated.json",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			creds := FindSpireCredentials(loadVcapFixture(t, tt.fixture))
+			if !reflect.DeepEqual(creds, tt.expected) {
+				t.Fatalf("credentials = %+v, expected %+v", creds, tt.expected)
+			}
+			if creds != nil && creds.SpireTrustDomain() != tt.trustDomain {
+				t.Errorf("trust domain = %q, expected %q", creds.SpireTrustDomain(), tt.trustDomain)
+			}
+		})
+	}
+}
+
+func TestPortUnmarshal(t *testing.T) {
+	tests := []struct {
+		json      string
+		expected  Port
+		expectErr bool
+	}{
+		{json: `8081`, expected: 8081},
+		{json: `"8081"`, expected: 8081},
+		{json: `" 8081 "`, expected: 8081},
+		{json: `""`, expected: 0},
+		{json: `"http"`, expectErr: true},
+		{json: `true`, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		var p Port
+		err := p.UnmarshalJSON([]byte(tt.json))
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.json)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.json, err)
+		}
+		if p != tt.expected {
+			t.Errorf("%s: port = %d, expected %d", tt.json, p, tt.expected)
+		}
+	}
+}
+
+func TestSpireBindingsOrder(t *testing.T) {
+	services := loadVcapFixture(t, "multiple.json")
+
+	for i := 0; i < 5; i++ {
+		var names []string
+		for _, b := range SpireBindings(services) {
+			names = append(names, b.Name)
+		}
+		if want := []string{"spire-a", "spire-b", "ups-spire"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("got bindings %v, want %v", names, want)
+		}
+	}
+}
+
+func TestSelectSpireBinding(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixture  string
+		selector BindingSelector
+		want     string
+		err      string
+	}{
+		{name: "several bindings", fixture: "multiple.json", err: "found 3 spire service bindings (spire-a, spire-b, ups-spire)"},
+		{name: "by name", fixture: "multiple.json", selector: BindingSelector{Name: "spire-b"}, want: "spire-b"},
+		{name: "by binding name", fixture: "multiple.json", selector: BindingSelector{Name: "spire-b-binding"}, want: "spire-b"},
+		{name: "by label", fixture: "multiple.json", selector: BindingSelector{Label: "user-provided"}, want: "ups-spire"},
+		{name: "by tag", fixture: "multiple.json", selector: BindingSelector{Tag: "dev"}, want: "spire-a"},
+		{name: "by label and tag", fixture: "multiple.json", selector: BindingSelector{Label: "spire", Tag: "prod"}, want: "spire-b"},
+		{name: "several by tag", fixture: "multiple.json", selector: BindingSelector{Tag: "prod"}, err: "found 2 spire service bindings (spire-b, ups-spire)"},
+		{name: "no match", fixture: "multiple.json", selector: BindingSelector{Name: "missing"}, err: "no spire service binding matches name `missing`"},
+		{name: "single binding", fixture: "nested.json", want: "my-spire"},
+		{name: "no spire binding", fixture: "unrelated.json"},
+		{name: "no spire binding with selector", fixture: "unrelated.json", selector: BindingSelector{Tag: "spire"}, err: "no spire service binding matches"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			binding, err := SelectSpireBinding(loadVcapFixture(t, tt.fixture), tt.selector)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing `%s`, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := ""
+			if binding != nil {
+				got = binding.Name
+			}
+			if got != tt.want {
+				t.Errorf("got binding %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveBindingSelectorIgnoresOtherSettings(t *testing.T) {
+	t.Setenv("SPIRE_SERVICE_TAG", "dev")
+	t.Setenv("SPIRE_ENVOY_LISTENER_PORT", "not a port")
+	config := map[string]interface{}{
+		"spire-agent": map[interface{}]interface{}{
+			"service": map[interface{}]interface{}{"label": "spire"},
+		},
+	}
+
+	selector := ResolveBindingSelector(config)
+	if want := (BindingSelector{Label: "spire", Tag: "dev"}); selector != want {
+		t.Errorf("got selector %+v, want %+v", selector, want)
+	}
+}
+
+func TestExtractSpireCredentialsMalformedVcap(t *testing.T) {
+	t.Setenv(VcapServicesEnv, `{"spire": [`)
+	s := &Supplier{Log: libbuildpack.NewLogger(io.Discard)}
+
+	if creds, err := s.ExtractSpireCredentialsFromVcapServices(); err == nil || creds != nil {
+		t.Errorf("expected a parse error, got %+v, %v", creds, err)
+	}
+}
+
+func TestInvalidSpireCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		vcap     string
+		expected string
+	}{
+		{
+			name:     "nested port",
+			vcap:     `{"spire": [{"name": "my-spire", "credentials": {"spire": {"host": "spire.example.org", "port": "http"}}}]}`,
+			expected: "`my-spire`",
+		},
+		{
+			name:     "flat port",
+			vcap:     `{"spire": [{"name": "spire-flat", "credentials": {"server_address": "spire.example.org:http", "trust_domain": "example.org"}}]}`,
+			expected: "invalid port `http`",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			services, err := ParseVcapServices(test.vcap)
+			if err != nil {
+				t.Fatalf("invalid credentials fail the parsing: %v", err)
+			}
+			_, err = SelectSpireBinding(services, BindingSelector{})
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("error %q doesn't mention %s", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestInvalidSpireCredentialsOfOtherBinding(t *testing.T) {
+	services, err := ParseVcapServices(`{"spire": [
+		{"name": "broken", "credentials": {"spire": {"host": "spire.example.org", "port": "http"}}},
+		{"name": "spire", "credentials": {"spire": {"host": "spire.example.org", "port": 8081}, "trust_domain": "example.org"}}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binding, err := SelectSpireBinding(services, BindingSelector{Name: "spire"})
+	if err != nil || binding == nil || binding.Name != "spire" {
+		t.Errorf("got binding %+v, %v; want `spire`", binding, err)
+	}
+	if creds := FindSpireCredentials(services); creds == nil || creds.TrustDomain != "example.org" {
+		t.Errorf("got credentials %+v, want the ones of `spire`", creds)
+	}
+}
+
+func TestUnrelatedCredentialsIgnored(t *testing.T) {
+	services, err := ParseVcapServices(`{"mysql": [{"name": "db", "credentials": {"port": "not a port"}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := services["mysql"][0].Credentials; creds == nil || creds.Spire != nil {
+		t.Errorf("got credentials %+v, want empty", creds)
+	}
+}
+
+func TestUnrelatedServerAddressIgnored(t *testing.T) {
+	services := loadVcapFixture(t, "unrelated_server_address.json")
+
+	if creds := services["ldap"][0].Credentials; creds == nil || creds.Spire != nil {
+		t.Errorf("got credentials %+v, want empty", creds)
+	}
+	if binding, err := SelectSpireBinding(services, BindingSelector{}); binding != nil || err != nil {
+		t.Errorf("got binding %+v, %v; want none", binding, err)
+	}
+}